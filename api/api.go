@@ -1,12 +1,18 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime/debug"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/docker/docker/client"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	mgo "gopkg.in/mgo.v2"
@@ -15,10 +21,13 @@ import (
 const version = "0.1.0"
 
 type handler struct {
-	config       *Config
-	languages    []*Language
-	dockerClient *client.Client
-	mgoClient    *mgo.Session
+	config    *Config
+	languages []*Language
+	executor  Executor
+	scheduler *scheduler
+	jobs      *runningJobs
+	cache     *resultCache
+	mgoClient *mgo.Session
 }
 
 func (h *handler) homeHandler(w http.ResponseWriter, r *http.Request) {
@@ -45,7 +54,9 @@ func (l logrusRecoveryHandlerLogger) Println(v ...interface{}) {
 func (h *handler) getAPIHandler() http.Handler {
 	r := mux.NewRouter()
 	r.HandleFunc("/", h.homeHandler).Methods("GET")
+	r.Handle("/debug/vars", expvar.Handler()).Methods("GET")
 	addSubrouter(r, "/run", h.runRouter)
+	addSubrouter(r, "/runs", h.jobsRouter)
 	addSubrouter(r, "/languages", h.languagesRouter)
 	addSubrouter(r, "/snippets", h.snippetsRouter)
 	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
@@ -65,9 +76,44 @@ func (h *handler) Serve() error {
 		Handler:      h.getAPIHandler(),
 		Addr:         h.config.HTTPAddr,
 		ReadTimeout:  timeout,
-		WriteTimeout: timeout + h.config.RunTimeout,
+		WriteTimeout: timeout + h.config.QueueTimeout + h.maxRunTimeout(),
 	}
-	return srv.ListenAndServe()
+	if h.config.EgressProxyAddr != "" {
+		l, sources, err := listenEgressProxy(h.config.EgressProxyAddr)
+		if err != nil {
+			return errors.New("egress proxy: " + err.Error())
+		}
+		proxy := &http.Server{
+			Handler:           newEgressProxy(h.config.EgressAllowlist, sources, h.config.EgressSizeLimit, h.maxRunTimeout()),
+			ReadHeaderTimeout: timeout,
+		}
+		go func() {
+			if err := proxy.Serve(l); err != http.ErrServerClosed {
+				log.Error("egress proxy: " + err.Error())
+			}
+		}()
+		defer proxy.Close()
+	}
+
+	// running runs get the read timeout to finish before the server exits
+	stopped := make(chan bool)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Info("server stopping")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			srv.Close()
+		}
+		close(stopped)
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
 }
 
 func NewDefaultServer() (h *handler, err error) {
@@ -88,17 +134,28 @@ func NewDefaultServer() (h *handler, err error) {
 		return nil, err
 	}
 
-	if h.dockerClient, err = client.NewEnvClient(); err != nil {
+	if h.executor, err = newExecutor(h.config, h.languages); err != nil {
 		return nil, err
 	}
+	h.scheduler = h.newScheduler()
+	h.jobs = newRunningJobs()
+	h.cache = newResultCache(h.config.CacheTTL, h.config.CacheSize)
 
 	if h.mgoClient, err = mgo.Dial(h.config.MongoURL); err != nil {
 		return nil, err
 	}
+	if err = h.ensureJobIndex(); err != nil {
+		return nil, err
+	}
 
 	return h, nil
 }
 
 func (h *handler) Close() {
+	if c, ok := h.executor.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Error(err.Error())
+		}
+	}
 	h.mgoClient.Close()
 }
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rojul/snip/api/runner"
+)
+
+const maxBatchSize = 20
+
+// batchEvent is an event of the payload at Index of a batch.
+type batchEvent struct {
+	Index int `json:"index"`
+	*runner.Event
+}
+
+// runFailed reports whether the run did not exit successfully or its output
+// was judged as wrong.
+func runFailed(r *runner.Result) bool {
+	return r.Error != "" || r.ExitCode == nil || *r.ExitCode != 0 ||
+		(r.Verdict != nil && r.Verdict.Status != runner.Accepted)
+}
+
+// runBatchHandler runs all payloads concurrently, limited by the scheduler.
+// The events are tagged with the index of their payload, the last line is
+// the array of results. With failFast=true the remaining runs are canceled
+// after the first failed run and skipped with an error.
+func (h *handler) runBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var payloads []Payload
+	if ok := readJSONBody(w, r, h.config.SnippetSizeLimit, &payloads); !ok {
+		return
+	}
+	if len(payloads) == 0 {
+		sendError(w, HTTPError{Status: http.StatusBadRequest, Msg: "At least one payload required"})
+		return
+	}
+	if len(payloads) > maxBatchSize {
+		sendError(w, HTTPError{Status: http.StatusBadRequest, Msg: "Too many payloads"})
+		return
+	}
+	failFast, _ := strconv.ParseBool(r.URL.Query().Get("failFast"))
+
+	languages := make([]*Language, len(payloads))
+	tickets := make([]*ticket, len(payloads))
+	for i := range payloads {
+		var err error
+		languages[i], tickets[i], err = h.prepareRun(r, &payloads[i])
+		if err != nil {
+			for _, t := range tickets[:i] {
+				t.release()
+			}
+			if httpErr, ok := err.(HTTPError); ok && err != HTTPErrorTooManyRuns {
+				httpErr.Msg = "Payload " + strconv.Itoa(i+1) + ": " + httpErr.Msg
+				err = httpErr
+			}
+			h.sendRunError(w, err)
+			return
+		}
+		payloads[i].noCache = noCacheRequested(r)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	out := make(chan *batchEvent)
+	results := make([]*runner.Result, len(payloads))
+	var wg sync.WaitGroup
+	for i := range payloads {
+		payloads[i].skipped = failed
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			events := make(chan *runner.Event)
+			done := make(chan bool)
+			go func() {
+				for e := range events {
+					out <- &batchEvent{Index: i, Event: e}
+				}
+				done <- true
+			}()
+			res, err := h.runContainer(ctx, &payloads[i], languages[i], tickets[i], events)
+			<-done
+			if err != nil {
+				log.Error(err.Error())
+				res = &runner.Result{Error: http.StatusText(http.StatusInternalServerError)}
+			}
+			results[i] = res
+			// a run canceled by the client does not skip the others
+			if failFast && runFailed(res) && r.Context().Err() == nil {
+				failOnce.Do(func() {
+					close(failed)
+					cancel()
+				})
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	s := newStreamWriter(w, r, 0)
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-out:
+			if !ok {
+				s.send(sseResult, results)
+				return
+			}
+			s.send(string(e.Type), e)
+		case <-heartbeat.C:
+			s.keepAlive()
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rojul/snip/api/runner"
+)
+
+func decodeBatchResponse(t *testing.T, body string) ([]*batchEvent, []*runner.Result) {
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	var events []*batchEvent
+	for _, l := range lines[:len(lines)-1] {
+		var e batchEvent
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, &e)
+	}
+	var results []*runner.Result
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &results); err != nil {
+		t.Fatal(err)
+	}
+	return events, results
+}
+
+func TestRunBatchHandler(t *testing.T) {
+	h := newFakeHandler()
+	w := doTestRequest(h, "POST", "/run/batch", `[
+		{"language": "ash", "files": [{"name": "main.sh", "content": "cat"}], "stdin": "0\n"},
+		{"language": "ash", "files": [{"name": "main.sh", "content": "cat"}], "stdin": "1\n"}
+	]`)
+	expectStatus(t, w, http.StatusOK)
+
+	events, results := decodeBatchResponse(t, w.Body.String())
+	if len(events) != 2 || len(results) != 2 {
+		t.Fatalf("unexpected response: %s", w.Body.String())
+	}
+	for _, e := range events {
+		if e.Message != strconv.Itoa(e.Index)+"\n" {
+			t.Errorf("unexpected event %s", mustToJSON(e))
+		}
+	}
+	for _, r := range results {
+		if runFailed(r) {
+			t.Errorf("unexpected result %s", mustToJSON(r))
+		}
+	}
+}
+
+// failingExecutor fails if the stdin is "fail" and runs until the context
+// is done otherwise.
+type failingExecutor struct{}
+
+func (failingExecutor) Execute(ctx context.Context, payload *runner.Payload, language *Language, resources Resources, stdin io.Reader, events chan<- *runner.Event) (*runner.Result, error) {
+	defer close(events)
+	if payload.Stdin == "fail" {
+		one := 1
+		return &runner.Result{ExitCode: &one}, nil
+	}
+	<-ctx.Done()
+	return &runner.Result{Error: "No response from container"}, nil
+}
+
+func TestRunBatchHandlerFailFast(t *testing.T) {
+	h := newFakeHandler()
+	h.executor = failingExecutor{}
+	aborted, skipped := abortedRuns.Value(), skippedRuns.Value()
+	w := doTestRequest(h, "POST", "/run/batch?failFast=true", `[
+		{"language": "ash", "files": [{"name": "main.sh", "content": "cat"}]},
+		{"language": "ash", "files": [{"name": "main.sh", "content": "cat"}], "stdin": "fail"}
+	]`)
+	expectStatus(t, w, http.StatusOK)
+
+	_, results := decodeBatchResponse(t, w.Body.String())
+	if len(results) != 2 || results[0].Error != "Skipped after failure" || *results[1].ExitCode != 1 {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+	if abortedRuns.Value() != aborted || skippedRuns.Value() != skipped+1 {
+		t.Errorf("expected the run to be counted as skipped, aborted %d, skipped %d", abortedRuns.Value()-aborted, skippedRuns.Value()-skipped)
+	}
+}
+
+func TestRunBatchHandlerErrors(t *testing.T) {
+	h := newFakeHandler()
+	w := doTestRequest(h, "POST", "/run/batch", `[
+		{"language": "ash", "files": [{"name": "main.sh", "content": "cat"}]},
+		{"language": "ash", "files": []}
+	]`)
+	expectStatus(t, w, http.StatusBadRequest)
+	if !strings.Contains(w.Body.String(), "Payload 2: Invalid payload") {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+
+	w = doTestRequest(h, "POST", "/run/batch", `[]`)
+	expectStatus(t, w, http.StatusBadRequest)
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rojul/snip/api/runner"
+)
+
+var (
+	cacheHits   = expvar.NewInt("cacheHits")
+	cacheMisses = expvar.NewInt("cacheMisses")
+)
+
+// imageIDer is implemented by executors which run languages in images. The
+// id is part of the cache key, so rebuilding an image invalidates the cache.
+type imageIDer interface {
+	imageID(ctx context.Context, language *Language) (string, error)
+}
+
+// resultCache holds the results and events of finished runs. size is the
+// most bytes the encoded entries may take up, when the cache is full the
+// least recently used entries are evicted.
+type resultCache struct {
+	ttl     time.Duration
+	size    int64
+	used    int64
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// cacheEntry stores the result and events as json, so callers can not modify
+// them and their size is known.
+type cacheEntry struct {
+	key     string
+	result  []byte
+	events  []byte
+	expires time.Time
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.result) + len(e.events))
+}
+
+// newResultCache returns nil if caching is disabled.
+func newResultCache(ttl time.Duration, size int64) *resultCache {
+	if ttl <= 0 || size <= 0 {
+		return nil
+	}
+	return &resultCache{
+		ttl:     ttl,
+		size:    size,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// get returns a copy of the cached result which is marked as cached.
+func (c *resultCache) get(key string) (*runner.Result, []*runner.Event, bool) {
+	if c == nil || key == "" {
+		return nil, nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		cacheMisses.Add(1)
+		return nil, nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		cacheMisses.Add(1)
+		return nil, nil, false
+	}
+	var r runner.Result
+	var events []*runner.Event
+	if json.Unmarshal(entry.result, &r) != nil || json.Unmarshal(entry.events, &events) != nil {
+		return nil, nil, false
+	}
+	c.lru.MoveToFront(el)
+	cacheHits.Add(1)
+	r.Cached = true
+	return &r, events, true
+}
+
+func (c *resultCache) put(key string, r *runner.Result, events []*runner.Event) {
+	if c == nil || key == "" {
+		return
+	}
+	result, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	eventsJSON, err := json.Marshal(events)
+	if err != nil {
+		return
+	}
+	entry := &cacheEntry{key: key, result: result, events: eventsJSON, expires: time.Now().Add(c.ttl)}
+	if entry.size() > c.size {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.used += entry.size()
+	for c.used > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *resultCache) remove(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, entry.key)
+	c.used -= entry.size()
+}
+
+// isCacheable reports whether the result does not depend on the load of the
+// server or a failure of the executor.
+func isCacheable(r *runner.Result) bool {
+	return r.Error == "" && !r.TimedOut && !r.OOMKilled
+}
+
+func noCacheRequested(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
+}
+
+// cacheKey returns the hash of everything which affects the result of the
+// payload or an empty string if the run can not be cached.
+func (h *handler) cacheKey(ctx context.Context, payload *Payload, language *Language, resources Resources) string {
+	if h.cache == nil || payload.noCache || payload.stdin != nil {
+		return ""
+	}
+	var imageID string
+	if e, ok := h.executor.(imageIDer); ok {
+		var err error
+		if imageID, err = e.imageID(ctx, language); err != nil {
+			log.Warn("image id for cache key: " + err.Error())
+			return ""
+		}
+	}
+	b, err := json.Marshal(&struct {
+		*Payload
+		Resources Resources
+	}{payload, resources})
+	if err != nil {
+		return ""
+	}
+	s := sha256.New()
+	s.Write([]byte(language.ID + "\x00" + imageID + "\x00"))
+	s.Write(b)
+	return hex.EncodeToString(s.Sum(nil))
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rojul/snip/api/runner"
+)
+
+func TestResultCacheEviction(t *testing.T) {
+	c := newResultCache(time.Hour, 1000)
+	c.put("a", &runner.Result{Reason: "a"}, nil)
+	c = newResultCache(time.Hour, 2*c.used)
+	for _, k := range []string{"a", "b"} {
+		c.put(k, &runner.Result{Reason: k}, nil)
+	}
+	c.get("a")
+	c.put("c", &runner.Result{}, nil)
+
+	if _, _, ok := c.get("b"); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	r, _, ok := c.get("a")
+	if !ok || !r.Cached || r.Reason != "a" {
+		t.Errorf("expected cached entry, actual %s", mustToJSON(r))
+	}
+
+	c.put("d", &runner.Result{Reason: strings.Repeat("d", int(c.size))}, nil)
+	if _, _, ok := c.get("d"); ok || c.used > c.size {
+		t.Errorf("expected entry larger than the cache to be skipped, used %d", c.used)
+	}
+}
+
+func TestResultCacheExpired(t *testing.T) {
+	c := newResultCache(time.Nanosecond, 1000)
+	c.put("a", &runner.Result{}, nil)
+	time.Sleep(time.Millisecond)
+	if _, _, ok := c.get("a"); ok {
+		t.Error("expected expired entry")
+	}
+}
+
+// countingExecutor counts the runs of the fake executor.
+type countingExecutor struct {
+	n *int
+}
+
+func (e countingExecutor) Execute(ctx context.Context, payload *runner.Payload, language *Language, resources Resources, stdin io.Reader, events chan<- *runner.Event) (*runner.Result, error) {
+	*e.n++
+	return fakeExecutor{}.Execute(ctx, payload, language, resources, stdin, events)
+}
+
+func TestRunHandlerCached(t *testing.T) {
+	var n int
+	h := newFakeHandler()
+	h.executor = countingExecutor{&n}
+	h.cache = newResultCache(time.Hour, 1000)
+	body := `{"language":"ash","files":[{"name":"main.sh","content":"cat"}],"stdin":"Hello World\n"}`
+
+	for i, noCache := range []bool{false, false, true} {
+		r := httptest.NewRequest("POST", "/run", strings.NewReader(body))
+		if noCache {
+			r.Header.Set("Cache-Control", "no-cache")
+		}
+		w := httptest.NewRecorder()
+		h.getAPIHandler().ServeHTTP(w, r)
+		expectStatus(t, w, http.StatusOK)
+
+		events, res := decodeRunResponse(t, w.Body.String())
+		res.Events = events
+		if !compareResult(res, "Hello World\n", "") {
+			t.Errorf("unexpected response: %s", w.Body.String())
+		}
+		if res.Cached != (i == 1) {
+			t.Errorf("run %d: unexpected cached %t", i, res.Cached)
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected 2 executions, actual %d", n)
+	}
+}
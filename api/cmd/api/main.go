@@ -6,11 +6,20 @@ import (
 )
 
 func main() {
+	// the local executor starts this binary again to run the runner
+	if api.IsLocalRunner() {
+		api.RunLocalRunner()
+		return
+	}
+
 	log.SetLevel(log.DebugLevel)
 	h, err := api.NewDefaultServer()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer h.Close()
-	log.Fatal(h.Serve())
+	err = h.Serve()
+	h.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -74,6 +74,9 @@ func handleLanguage(dirname, id string) (*api.Language, error) {
 		return nil, err
 	}
 	l.ID = id
+	if err := api.ValidateLanguageLimits(l); err != nil {
+		return nil, err
+	}
 	return l, nil
 }
 
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLanguages(t *testing.T) {
+	dir := "../../../languages"
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		t.Skip("languages not found")
+	}
+	ids, err := getLanguageIDs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if _, err := handleLanguage(dir, id); err != nil {
+			t.Errorf("%s: %v", id, err)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package api
 
 import (
+	"errors"
 	"reflect"
+	"strings"
 	"time"
 
 	units "github.com/docker/go-units"
@@ -9,38 +11,131 @@ import (
 )
 
 type Config struct {
-	RunTimeout         time.Duration `mapstructure:"RUN_TIMEOUT"`
-	Memory             int64         `mapstructure:"MEMORY"`
-	NanoCPUs           int64         `mapstructure:"NANO_CPUS"`
-	CPUShares          int64         `mapstructure:"CPU_SHARES"`
-	PidsLimit          int64         `mapstructure:"PIDS_LIMIT"`
-	NetworkEnabled     bool          `mapstructure:"NETWORK_ENABLED"`
-	MongoURL           string        `mapstructure:"MONGO_URL"`
-	MongoDB            string        `mapstructure:"MONGO_DB"`
-	JSONLogging        bool          `mapstructure:"JSON_LOGGING"`
-	SnippetSizeLimit   int64         `mapstructure:"SNIPPET_SIZE_LIMIT"`
-	ReturnSizeLimit    int64         `mapstructure:"RETURN_SIZE_LIMIT"`
-	CorsEnabled        bool          `mapstructure:"CORS_ENABLED"`
-	HTTPAddr           string        `mapstructure:"HTTP_ADDR"`
-	DefaultImagePrefix string        `mapstructure:"DEFAULT_IMAGE_PREFIX"`
-	LanguagesFile      string        `mapstructure:"LANGUAGES_FILE"`
+	Executor            string        `mapstructure:"EXECUTOR"`
+	LocalIDBase         int           `mapstructure:"LOCAL_ID_BASE"`
+	LocalBinds          string        `mapstructure:"LOCAL_BINDS"`
+	RunTimeout          time.Duration `mapstructure:"RUN_TIMEOUT"`
+	Memory              int64         `mapstructure:"MEMORY"`
+	NanoCPUs            int64         `mapstructure:"NANO_CPUS"`
+	CPUShares           int64         `mapstructure:"CPU_SHARES"`
+	PidsLimit           int64         `mapstructure:"PIDS_LIMIT"`
+	MaxRunTimeout       time.Duration `mapstructure:"MAX_RUN_TIMEOUT"`
+	MaxMemory           int64         `mapstructure:"MAX_MEMORY"`
+	MaxNanoCPUs         int64         `mapstructure:"MAX_NANO_CPUS"`
+	MaxPidsLimit        int64         `mapstructure:"MAX_PIDS_LIMIT"`
+	LimitsToken         string        `mapstructure:"LIMITS_TOKEN"`
+	NetworkEnabled      bool          `mapstructure:"NETWORK_ENABLED"`
+	Network             string        `mapstructure:"NETWORK"`
+	EgressProxyAddr     string        `mapstructure:"EGRESS_PROXY_ADDR"`
+	EgressProxyURL      string        `mapstructure:"EGRESS_PROXY_URL"`
+	EgressAllowlist     string        `mapstructure:"EGRESS_ALLOWLIST"`
+	EgressSizeLimit     int64         `mapstructure:"EGRESS_SIZE_LIMIT"`
+	MongoURL            string        `mapstructure:"MONGO_URL"`
+	MongoDB             string        `mapstructure:"MONGO_DB"`
+	JSONLogging         bool          `mapstructure:"JSON_LOGGING"`
+	SnippetSizeLimit    int64         `mapstructure:"SNIPPET_SIZE_LIMIT"`
+	ReturnSizeLimit     int64         `mapstructure:"RETURN_SIZE_LIMIT"`
+	StdoutLimit         int64         `mapstructure:"STDOUT_LIMIT"`
+	StderrLimit         int64         `mapstructure:"STDERR_LIMIT"`
+	ArtifactSizeLimit   int64         `mapstructure:"ARTIFACT_SIZE_LIMIT"`
+	CorsEnabled         bool          `mapstructure:"CORS_ENABLED"`
+	HTTPAddr            string        `mapstructure:"HTTP_ADDR"`
+	DefaultImagePrefix  string        `mapstructure:"DEFAULT_IMAGE_PREFIX"`
+	LanguagesFile       string        `mapstructure:"LANGUAGES_FILE"`
+	MaxConcurrency      int           `mapstructure:"MAX_CONCURRENCY"`
+	LanguageConcurrency int           `mapstructure:"LANGUAGE_CONCURRENCY"`
+	QueueSize           int           `mapstructure:"QUEUE_SIZE"`
+	QueueTimeout        time.Duration `mapstructure:"QUEUE_TIMEOUT"`
+	PoolSize            int           `mapstructure:"POOL_SIZE"`
+	PoolTTL             time.Duration `mapstructure:"POOL_TTL"`
+	PoolLanguages       string        `mapstructure:"POOL_LANGUAGES"`
+	JobTTL              time.Duration `mapstructure:"JOB_TTL"`
+	CacheTTL            time.Duration `mapstructure:"CACHE_TTL"`
+	CacheSize           int64         `mapstructure:"CACHE_SIZE"`
 }
 
 func defaultConfig() *Config {
 	return &Config{
+		Executor:           "docker",
+		LocalIDBase:        0x70000000, // above the usual /etc/subuid and systemd-nspawn ranges
+		LocalBinds:         "/bin,/sbin,/usr,/lib,/lib32,/lib64,/libx32,/etc/alternatives,/etc/ld.so.cache",
 		RunTimeout:         15 * time.Second,
 		Memory:             512 * units.MiB,
 		CPUShares:          64,
 		PidsLimit:          35,
+		EgressSizeLimit:    10 * units.MiB,
 		SnippetSizeLimit:   1 * units.MiB,
 		MongoURL:           "mongo",
 		MongoDB:            "snip",
 		DefaultImagePrefix: "snip",
 		LanguagesFile:      "languages.json",
 		ReturnSizeLimit:    100 * units.KiB,
+		StdoutLimit:        32 * units.KiB,
+		StderrLimit:        16 * units.KiB,
+		ArtifactSizeLimit:  32 * units.KiB,
+		PoolTTL:            5 * time.Minute,
+		MaxConcurrency:     16,
+		QueueSize:          100,
+		QueueTimeout:       30 * time.Second,
+		JobTTL:             time.Hour,
+		CacheSize:          32 * units.MiB,
 	}
 }
 
+func (c *Config) getValidationError() error {
+	for _, l := range []struct {
+		name   string
+		v, max int64
+	}{
+		{"RUN_TIMEOUT", int64(c.RunTimeout), int64(c.MaxRunTimeout)},
+		{"MEMORY", c.Memory, c.MaxMemory},
+		{"NANO_CPUS", c.NanoCPUs, c.MaxNanoCPUs},
+		{"PIDS_LIMIT", c.PidsLimit, c.MaxPidsLimit},
+	} {
+		if l.max > 0 && l.v > l.max {
+			return errors.New(l.name + " exceeds MAX_" + l.name)
+		}
+	}
+	if c.StdoutLimit <= 0 {
+		return errors.New("STDOUT_LIMIT must be positive")
+	}
+	if c.StderrLimit <= 0 {
+		return errors.New("STDERR_LIMIT must be positive")
+	}
+	if c.ArtifactSizeLimit < 0 {
+		return errors.New("ARTIFACT_SIZE_LIMIT can not be negative")
+	}
+	if c.StdoutLimit+c.StderrLimit+c.ArtifactSizeLimit > c.ReturnSizeLimit {
+		return errors.New("STDOUT_LIMIT, STDERR_LIMIT and ARTIFACT_SIZE_LIMIT must fit into RETURN_SIZE_LIMIT")
+	}
+	return nil
+}
+
+// eventSizeLimit is the size of the events of a run which are returned, the
+// rest of ReturnSizeLimit is kept for the result.
+func (c *Config) eventSizeLimit() int64 {
+	return c.ReturnSizeLimit - c.ArtifactSizeLimit
+}
+
+// runnerLineLimit is the longest line of the runner output which is read.
+// The result line is not part of eventSizeLimit, it holds the base64
+// encoded artifacts and the other fields of the result.
+func (c *Config) runnerLineLimit() int64 {
+	return c.ReturnSizeLimit*4/3 + 64*units.KiB
+}
+
+// isPoolLanguage reports whether containers of the language are started
+// ahead of time by the pool. PoolLanguages is a comma separated list of
+// language IDs.
+func (c *Config) isPoolLanguage(id string) bool {
+	for _, l := range strings.Split(c.PoolLanguages, ",") {
+		if strings.TrimSpace(l) == id {
+			return true
+		}
+	}
+	return false
+}
+
 func parseInt64WithUnit(v *viper.Viper, f func(string) (int64, error), key string) {
 	s := v.GetString(key)
 	if s == "" {
@@ -63,10 +158,29 @@ func configFromEnv() (*Config, error) {
 	}
 
 	parseInt64WithUnit(v, units.RAMInBytes, "memory")
+	parseInt64WithUnit(v, units.RAMInBytes, "max_memory")
 	parseInt64WithUnit(v, units.FromHumanSize, "snippet_size_limit")
 	parseInt64WithUnit(v, units.FromHumanSize, "return_size_limit")
+	parseInt64WithUnit(v, units.FromHumanSize, "stdout_limit")
+	parseInt64WithUnit(v, units.FromHumanSize, "stderr_limit")
+	parseInt64WithUnit(v, units.FromHumanSize, "artifact_size_limit")
+	parseInt64WithUnit(v, units.FromHumanSize, "egress_size_limit")
+	parseInt64WithUnit(v, units.FromHumanSize, "cache_size")
 
 	c := defaultConfig()
-	err := v.Unmarshal(&c)
-	return c, err
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	// like the defaults, the size limits which are not configured are shares
+	// of RETURN_SIZE_LIMIT
+	if !v.IsSet("stdout_limit") {
+		c.StdoutLimit = c.ReturnSizeLimit * 32 / 100
+	}
+	if !v.IsSet("stderr_limit") {
+		c.StderrLimit = c.ReturnSizeLimit * 16 / 100
+	}
+	if !v.IsSet("artifact_size_limit") {
+		c.ArtifactSizeLimit = c.ReturnSizeLimit * 32 / 100
+	}
+	return c, c.getValidationError()
 }
@@ -3,6 +3,7 @@ package api
 import (
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,8 +19,10 @@ func TestEnvConfig(t *testing.T) {
 	}{
 		{"RUN_TIMEOUT", "5s", "RunTimeout", 5 * time.Second},
 		{"MEMORY", "5m", "Memory", 5 * int64(units.MiB)},
+		{"MAX_MEMORY", "1g", "MaxMemory", int64(units.GiB)},
 		{"JSON_LOGGING", "true", "JSONLogging", true},
 		{"SNIPPET_SIZE_LIMIT", "5k", "SnippetSizeLimit", 5 * int64(units.KB)},
+		{"STDOUT_LIMIT", "1k", "StdoutLimit", int64(units.KB)},
 	}
 
 	for _, tt := range envTests {
@@ -36,3 +39,36 @@ func TestEnvConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigValidation(t *testing.T) {
+	c := defaultConfig()
+	c.MaxMemory = c.Memory
+	if err := c.getValidationError(); err != nil {
+		t.Error(err)
+	}
+	c.RunTimeout = 2 * time.Minute
+	c.MaxRunTimeout = time.Minute
+	if err := c.getValidationError(); err == nil || err.Error() != "RUN_TIMEOUT exceeds MAX_RUN_TIMEOUT" {
+		t.Errorf("expected error for a global above its maximum, actual %v", err)
+	}
+}
+
+func TestConfigSizeLimits(t *testing.T) {
+	os.Setenv("SNIP_RETURN_SIZE_LIMIT", "10k")
+	os.Setenv("SNIP_STDOUT_LIMIT", "2k")
+	defer os.Unsetenv("SNIP_RETURN_SIZE_LIMIT")
+	defer os.Unsetenv("SNIP_STDOUT_LIMIT")
+
+	c, err := configFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.StdoutLimit != 2000 || c.StderrLimit != 1600 || c.ArtifactSizeLimit != 3200 {
+		t.Errorf("expected limits following RETURN_SIZE_LIMIT, actual %d %d %d", c.StdoutLimit, c.StderrLimit, c.ArtifactSizeLimit)
+	}
+
+	c.ArtifactSizeLimit = -1
+	if err := c.getValidationError(); err == nil || !strings.Contains(err.Error(), "ARTIFACT_SIZE_LIMIT") {
+		t.Errorf("expected error naming ARTIFACT_SIZE_LIMIT, actual %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/rojul/snip/api/runner"
+)
+
+// dockerExecutor runs every payload in a new container of the language image.
+// Containers are never reused, but may be started ahead of time by the pool.
+type dockerExecutor struct {
+	config *Config
+	client *client.Client
+	pool   *containerPool
+}
+
+func newDockerExecutor(config *Config, languages []*Language) (*dockerExecutor, error) {
+	c, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	e := &dockerExecutor{config: config, client: c}
+	if config.Network != "" {
+		if err := e.checkRunNetwork(); err != nil {
+			return nil, err
+		}
+	}
+	if config.PoolSize > 0 {
+		e.pool = newContainerPool(config.PoolSize, config.PoolTTL, config.isPoolLanguage, e.startPoolContainer, e.removeContainer)
+		for _, l := range languages {
+			if !l.NotRunnable {
+				e.pool.fill(l)
+			}
+		}
+	}
+	return e, nil
+}
+
+// checkRunNetwork makes sure that runs with allowlisted egress can only
+// leave their network through the egress proxy. Outside of an internal
+// network the proxy environment is just a hint, which programs can ignore.
+func (e *dockerExecutor) checkRunNetwork() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	n, err := e.client.NetworkInspect(ctx, e.config.Network)
+	if err != nil {
+		return err
+	}
+	if !n.Internal {
+		return errors.New("NETWORK " + e.config.Network + " has to be an internal network")
+	}
+	return nil
+}
+
+// Close removes the containers of the pool.
+func (e *dockerExecutor) Close() error {
+	e.pool.close()
+	return nil
+}
+
+// removeContainer kills and removes the container. Containers which are
+// already gone or being removed are not an error.
+func (e *dockerExecutor) removeContainer(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := e.client.ContainerRemove(ctx, id, dockerTypes.ContainerRemoveOptions{Force: true}); err != nil {
+		if strings.Contains(err.Error(), "is already in progress") ||
+			strings.Contains(err.Error(), "No such container") {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// logRemoveContainer removes the container and logs a failure, as the
+// container is leaked then.
+func (e *dockerExecutor) logRemoveContainer(id string) {
+	if err := e.removeContainer(id); err != nil {
+		log.WithField("id", id).Error("removing container failed: " + err.Error())
+	}
+}
+
+// startedContainer is a running container whose runner waits for the payload.
+type startedContainer struct {
+	id       string
+	language *Language
+	conn     dockerTypes.HijackedResponse
+	started  time.Time
+}
+
+func (e *dockerExecutor) image(language *Language) string {
+	if language.Image == "" {
+		return e.config.DefaultImagePrefix + "/" + language.ID
+	}
+	return language.Image
+}
+
+func (e *dockerExecutor) imageID(ctx context.Context, language *Language) (string, error) {
+	info, _, err := e.client.ImageInspectWithRaw(ctx, e.image(language))
+	return info.ID, err
+}
+
+// startPoolContainer starts a container with the default resources of the
+// language.
+func (e *dockerExecutor) startPoolContainer(ctx context.Context, language *Language) (*startedContainer, error) {
+	return e.startContainer(ctx, language, e.config.resources(language.Limits))
+}
+
+func (e *dockerExecutor) startContainer(ctx context.Context, language *Language, resources Resources) (*startedContainer, error) {
+	containerConfig := &container.Config{
+		Image:           e.image(language),
+		AttachStdin:     true,
+		AttachStdout:    true,
+		AttachStderr:    true,
+		OpenStdin:       true,
+		StdinOnce:       true,
+		NetworkDisabled: resources.Network == networkNone,
+		User:            "1000:1000",
+	}
+	hostConfig := &container.HostConfig{
+		CapDrop: []string{"ALL"},
+		Resources: container.Resources{
+			Memory:     resources.Memory,
+			MemorySwap: resources.Memory,
+			NanoCPUs:   resources.NanoCPUs,
+			CPUShares:  e.config.CPUShares,
+			PidsLimit:  resources.PidsLimit,
+		},
+		LogConfig: container.LogConfig{
+			Type: "none",
+		},
+		Tmpfs: map[string]string{
+			"/tmp":       "exec",
+			"/home/snip": "exec,uid=1000,gid=1000",
+		},
+		ReadonlyRootfs: true,
+	}
+	if resources.Network == networkAllowlist {
+		hostConfig.NetworkMode = container.NetworkMode(e.config.Network)
+		if e.config.EgressProxyURL != "" {
+			containerConfig.Env = proxyEnv(e.config.EgressProxyURL)
+		}
+	}
+
+	c, err := e.client.ContainerCreate(ctx, containerConfig, hostConfig, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"id":       c.ID[:12],
+		"language": language.ID,
+	}).Debug("container started")
+
+	attachOptions := dockerTypes.ContainerAttachOptions{
+		Stream: true,
+		Stdin:  true,
+		Stdout: true,
+		Stderr: true,
+	}
+
+	res, err := e.client.ContainerAttach(ctx, c.ID, attachOptions)
+	if err != nil {
+		e.logRemoveContainer(c.ID)
+		return nil, err
+	}
+
+	err = e.client.ContainerStart(ctx, c.ID, dockerTypes.ContainerStartOptions{})
+	if err != nil {
+		res.Close()
+		e.logRemoveContainer(c.ID)
+		return nil, err
+	}
+
+	return &startedContainer{id: c.ID, language: language, conn: res, started: time.Now()}, nil
+}
+
+func (e *dockerExecutor) Execute(ctx context.Context, payload *runner.Payload, language *Language, resources Resources, stdin io.Reader, events chan<- *runner.Event) (*runner.Result, error) {
+	defer close(events)
+	ctx, cancel := context.WithTimeout(ctx, resources.Timeout)
+	defer cancel()
+
+	var sc *startedContainer
+	// pooled containers are started with the default resources of the language
+	if resources == e.config.resources(language.Limits) {
+		sc = e.pool.get(language)
+	}
+	if sc == nil {
+		var err error
+		if sc, err = e.startContainer(ctx, language, resources); err != nil {
+			return nil, err
+		}
+	}
+	res := sc.conn
+	defer res.Close()
+
+	go func() {
+		<-ctx.Done()
+		e.logRemoveContainer(sc.id)
+	}()
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	res.Conn.Write(payloadBytes)
+	if stdin == nil {
+		res.CloseWrite()
+	} else {
+		go func() {
+			io.Copy(res.Conn, stdin)
+			res.CloseWrite()
+		}()
+	}
+
+	var result *runner.Result
+	done := make(chan bool)
+	stdout, stdoutW := io.Pipe()
+	go func() {
+		result = decodeRunnerOutput(stdout, e.config.eventSizeLimit(), e.config.runnerLineLimit(), events)
+		done <- true
+	}()
+
+	stderr, err := demuxDockerStream(res.Reader, stdoutW, e.config.ReturnSizeLimit)
+	stdoutW.Close()
+	<-done
+	if stderr != "" {
+		return &runner.Result{Error: "Container returned an error:\n\n" + stderr}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return &runner.Result{Error: "Container timed out", TimedOut: true, Output: result.Output, Truncated: result.Truncated}, nil
+	}
+	if result.IsEmpty() {
+		result.Error = "No response from container"
+	}
+	if e.isOOMKilled(ctx, sc.id) {
+		result.SetOOMKilled()
+	}
+
+	return result, nil
+}
+
+func (e *dockerExecutor) isOOMKilled(ctx context.Context, id string) bool {
+	if _, err := e.client.ContainerWait(ctx, id); err != nil {
+		return false
+	}
+	info, err := e.client.ContainerInspect(ctx, id)
+	if err != nil {
+		log.Debug("inspecting container failed: " + err.Error())
+		return false
+	}
+	return info.State != nil && info.State.OOMKilled
+}
+
+// demuxDockerStream copies the stdout frames of the attached stream to
+// stdout and returns the content of the stderr frames, which is cut after
+// stderrLimit bytes.
+func demuxDockerStream(stream io.Reader, stdout io.Writer, stderrLimit int64) (string, error) {
+	var stderr bytes.Buffer
+	stderrW := &limitedWriter{&stderr, stderrLimit}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(stream, header); err != nil {
+			if err == io.EOF {
+				return stderr.String(), nil
+			}
+			return "", err
+		}
+
+		frameSize := int64(binary.BigEndian.Uint32(header[4:]))
+		var w io.Writer
+		switch header[0] {
+		case 1:
+			w = stdout
+		case 2:
+			w = stderrW
+		default:
+			return "", fmt.Errorf("invalid STREAM_TYPE: %x", header[0])
+		}
+		if _, err := io.CopyN(w, stream, frameSize); err != nil {
+			return "", err
+		}
+	}
+}
+
+// limitedWriter discards everything following the first n bytes.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (lw *limitedWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > lw.n {
+		lw.w.Write(b[:lw.n])
+		lw.n = 0
+		return len(b), nil
+	}
+	lw.n -= int64(len(b))
+	return lw.w.Write(b)
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// networkNone means the run has no network access
+	networkNone = "none"
+	// networkAllowlist means the run is attached to the network of the
+	// config and can only reach the allowlist through the egress proxy
+	networkAllowlist = "allowlist"
+	// networkFull means the run has unrestricted network access
+	networkFull = "full"
+)
+
+// hopHeaders are removed from requests which are forwarded by the proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// egressProxy is a HTTP proxy for runs with network access. The network of
+// these runs should be internal, so the proxy is their only way out. It
+// only serves clients of the sources network and only connects to the
+// host:port pairs of the allowlist. Every request and response body is cut
+// after sizeLimit bytes, tunnels are closed after timeout.
+type egressProxy struct {
+	allowed   map[string]bool
+	sources   *net.IPNet
+	sizeLimit int64
+	timeout   time.Duration
+	transport *http.Transport
+}
+
+// newEgressProxy parses a comma separated list of host:port pairs.
+func newEgressProxy(allowlist string, sources *net.IPNet, sizeLimit int64, timeout time.Duration) *egressProxy {
+	p := &egressProxy{
+		allowed:   map[string]bool{},
+		sources:   sources,
+		sizeLimit: sizeLimit,
+		timeout:   timeout,
+		transport: &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+	for _, hostport := range strings.Split(allowlist, ",") {
+		if hostport = strings.TrimSpace(hostport); hostport != "" {
+			p.allowed[strings.ToLower(hostport)] = true
+		}
+	}
+	return p
+}
+
+// listenEgressProxy listens on addr, which has to be an address of the api
+// in the run network, and returns the subnet of that address. Listening on
+// all interfaces would make the proxy open to everyone.
+func listenEgressProxy(addr string) (net.Listener, *net.IPNet, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		return nil, nil, errors.New("EGRESS_PROXY_ADDR must be an IP address in NETWORK")
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				return nil, nil, err
+			}
+			return l, &net.IPNet{IP: ip.Mask(n.Mask), Mask: n.Mask}, nil
+		}
+	}
+	return nil, nil, errors.New("EGRESS_PROXY_ADDR is not an address of this host")
+}
+
+// isSource reports whether the client is in the sources network.
+func (p *egressProxy) isSource(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && p.sources != nil && p.sources.Contains(ip)
+}
+
+// isAllowed reports whether host, which may omit the port, is allowlisted.
+func (p *egressProxy) isAllowed(host, defaultPort string) bool {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, defaultPort)
+	}
+	return p.allowed[strings.ToLower(host)]
+}
+
+func (p *egressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.isSource(r.RemoteAddr) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if r.Method == "CONNECT" {
+		p.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() || r.URL.Scheme != "http" {
+		http.Error(w, "Only proxy requests are supported", http.StatusBadRequest)
+		return
+	}
+	if !p.isAllowed(r.URL.Host, "80") {
+		p.deny(w, r.URL.Host)
+		return
+	}
+
+	out := r.WithContext(r.Context())
+	out.RequestURI = ""
+	if r.Body != nil {
+		out.Body = http.MaxBytesReader(w, r.Body, p.sizeLimit)
+	}
+	out.Header = http.Header{}
+	for k, v := range r.Header {
+		out.Header[k] = v
+	}
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	res, err := p.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	if res.ContentLength > p.sizeLimit {
+		http.Error(w, "Response too large", http.StatusBadGateway)
+		return
+	}
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.StatusCode)
+	if n, _ := io.CopyN(w, res.Body, p.sizeLimit+1); n > p.sizeLimit {
+		// the client has to notice that the body is incomplete
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// tunnel handles CONNECT requests, e.g. for HTTPS.
+func (p *egressProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	if !p.isAllowed(r.Host, "443") {
+		p.deny(w, r.Host)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Tunneling unsupported", http.StatusInternalServerError)
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	deadline := time.Now().Add(p.timeout)
+	conn.SetDeadline(deadline)
+	upstream.SetDeadline(deadline)
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		io.CopyN(upstream, conn, p.sizeLimit)
+		upstream.Close()
+	}()
+	io.CopyN(conn, upstream, p.sizeLimit)
+	conn.Close()
+}
+
+func (p *egressProxy) deny(w http.ResponseWriter, host string) {
+	log.WithField("host", host).Info("egress denied")
+	http.Error(w, "Host is not allowlisted", http.StatusForbidden)
+}
+
+// proxyEnv returns the environment which makes most tools use the proxy.
+func proxyEnv(url string) []string {
+	var env []string
+	for _, k := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		env = append(env, k+"="+url)
+	}
+	return env
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/rojul/snip/api/runner"
+)
+
+var loopback = &net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}
+
+func TestEgressProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Query().Get("body")))
+	}))
+	defer upstream.Close()
+	allowed := strings.TrimPrefix(upstream.URL, "http://")
+
+	proxy := httptest.NewServer(newEgressProxy("example.com:443, "+allowed, loopback, 10, time.Minute))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	res, err := client.Get(upstream.URL + "?body=ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected allowlisted host to be reachable, status %d", res.StatusCode)
+	}
+
+	res, err = client.Get(upstream.URL + "?body=" + strings.Repeat("x", 11))
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadGateway {
+			t.Errorf("expected a too large response to fail, status %d", res.StatusCode)
+		}
+	}
+
+	res, err = client.Get("http://example.org/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected host to be denied, status %d", res.StatusCode)
+	}
+}
+
+func TestEgressProxyTunnel(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(newEgressProxy(strings.TrimPrefix(upstream.URL, "https://"), loopback, 1<<20, time.Minute))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	transport := upstream.Client().Transport.(*http.Transport)
+	transport.Proxy = http.ProxyURL(proxyURL)
+
+	res, err := upstream.Client().Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("unexpected response %q", body)
+	}
+}
+
+func TestEgressProxyIsAllowed(t *testing.T) {
+	p := newEgressProxy("Example.com:443,localhost:8080", loopback, 0, 0)
+	var tests = []struct {
+		host     string
+		expected bool
+	}{
+		{"example.com:443", true},
+		{"EXAMPLE.COM", true},
+		{"example.com:80", false},
+		{"localhost:8080", true},
+		{"localhost", false},
+	}
+	for _, tt := range tests {
+		if actual := p.isAllowed(tt.host, "443"); actual != tt.expected {
+			t.Errorf("%s: expected %t, actual %t", tt.host, tt.expected, actual)
+		}
+	}
+}
+
+func TestEgressProxySources(t *testing.T) {
+	_, sources, _ := net.ParseCIDR("10.0.0.0/24")
+	proxy := httptest.NewServer(newEgressProxy("example.com:80", sources, 10, time.Minute))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	res, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected clients outside of the sources to be denied, status %d", res.StatusCode)
+	}
+}
+
+func TestListenEgressProxy(t *testing.T) {
+	for _, addr := range []string{":0", "0.0.0.0:0", "192.0.2.1:0"} {
+		if _, _, err := listenEgressProxy(addr); err == nil {
+			t.Errorf("%s: expected error", addr)
+		}
+	}
+	l, sources, err := listenEgressProxy("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if sources.String() != "127.0.0.0/8" {
+		t.Errorf("unexpected sources %s", sources)
+	}
+}
+
+func TestEgressDirectConnection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	ctx := context.Background()
+	client := testH.executor.(*dockerExecutor).client
+	c := *testH.config
+	c.Network = "snip-test-egress"
+
+	for _, internal := range []bool{false, true} {
+		n, err := client.NetworkCreate(ctx, c.Network, dockerTypes.NetworkCreate{Internal: internal})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.NetworkRemove(ctx, n.ID)
+
+		e, err := newDockerExecutor(&c, nil)
+		if !internal {
+			if err == nil {
+				t.Error("expected a network which is not internal to be refused")
+			}
+			client.NetworkRemove(ctx, n.ID)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := *testH
+		h.config = &c
+		h.executor = e
+		l := *mustGetAsh()
+		l.Network = true
+		p := &Payload{Language: l.ID, Network: true}
+		p.Files = []*runner.File{{Name: "main.sh", Content: "wget -q -T 5 -Y off -O /dev/null http://1.1.1.1/"}}
+		r, err := h.runContainerSync(ctx, p, &l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ExitCode == nil || *r.ExitCode == 0 {
+			t.Errorf("expected a direct connection to fail, actual %s", mustToJSON(r))
+		}
+	}
+}
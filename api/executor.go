@@ -0,0 +1,74 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/rojul/snip/api/runner"
+)
+
+// Executor runs a payload of a language. Events are sent while the program is
+// running and events is closed before Execute returns the final result.
+// A returned error is an internal error and is not shown to the user.
+// resources are the limits of the run. stdin is only set for interactive
+// payloads and is streamed to the runner after the payload.
+type Executor interface {
+	Execute(ctx context.Context, payload *runner.Payload, language *Language, resources Resources, stdin io.Reader, events chan<- *runner.Event) (*runner.Result, error)
+}
+
+func newExecutor(config *Config, languages []*Language) (Executor, error) {
+	switch config.Executor {
+	case "docker":
+		return newDockerExecutor(config, languages)
+	case "local":
+		return newLocalExecutor(config)
+	default:
+		return nil, errors.New("unknown executor: " + config.Executor)
+	}
+}
+
+// decodeRunnerOutput reads the lines written by runner.Run, sends the events
+// and returns the final result. Once the events exceed limit bytes, the
+// following events are dropped and the result is marked as truncated, but
+// the output is still read to the end to get the result. Lines longer than
+// lineLimit are an invalid response.
+func decodeRunnerOutput(r io.Reader, limit, lineLimit int64, events chan<- *runner.Event) *runner.Result {
+	defer io.Copy(ioutil.Discard, r)
+	result := &runner.Result{}
+	var n int64
+	var output runner.Output
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 4096), int(lineLimit)+1)
+	for s.Scan() {
+		var e runner.Event
+		if err := json.Unmarshal(s.Bytes(), &e); err == nil && e.Type != "" {
+			switch e.Type {
+			case runner.Stdout:
+				output.Stdout += int64(len(e.Message))
+			case runner.Stderr:
+				output.Stderr += int64(len(e.Message))
+			}
+			n += int64(len(s.Bytes())) + 1
+			if n > limit {
+				result.Truncated = true
+				continue
+			}
+			events <- &e
+		} else if err := json.Unmarshal(s.Bytes(), result); err == nil && !result.IsEmpty() {
+		} else {
+			return &runner.Result{Error: "Invalid response: " + s.Text()}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return &runner.Result{Error: "Invalid response: " + err.Error()}
+	}
+	// the runner counts the output including the bytes it already cut
+	if result.Output == nil && (output.Stdout > 0 || output.Stderr > 0) {
+		result.Output = &output
+	}
+	return result
+}
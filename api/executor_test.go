@@ -0,0 +1,69 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/rojul/snip/api/runner"
+)
+
+func dockerFrame(stream byte, s string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(s)))
+	return append(header, s...)
+}
+
+func TestDemuxDockerStream(t *testing.T) {
+	var stream bytes.Buffer
+	// lines can be split across frames
+	stream.Write(dockerFrame(1, `{"type":"std`))
+	stream.Write(dockerFrame(2, "error 1\n"))
+	stream.Write(dockerFrame(1, `out","message":"x"}`+"\n"))
+	stream.Write(dockerFrame(2, "error 2\n"))
+
+	var stdout bytes.Buffer
+	stderr, err := demuxDockerStream(&stream, &stdout, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != `{"type":"stdout","message":"x"}`+"\n" || stderr != "error 1\ner" {
+		t.Errorf("unexpected output %q %q", stdout.String(), stderr)
+	}
+}
+
+func TestDecodeRunnerOutputTruncated(t *testing.T) {
+	line := `{"type":"stdout","phase":"run","message":"x"}` + "\n"
+	output := strings.Repeat(line, 3) + `{"exitCode":0,"run":{"exitCode":0,"duration":1}}` + "\n"
+
+	events := make(chan *runner.Event)
+	done := make(chan int)
+	go func() {
+		n := 0
+		for range events {
+			n++
+		}
+		done <- n
+	}()
+	r := decodeRunnerOutput(strings.NewReader(output), int64(2*len(line)+10), 1024, events)
+	close(events)
+
+	if n := <-done; n != 2 {
+		t.Errorf("expected the 2 events before the limit, actual %d", n)
+	}
+	if !r.Truncated || r.ExitCode == nil || r.Run == nil || r.Output == nil || r.Output.Stdout != 3 {
+		t.Errorf("expected truncated result with exit code, actual %s", mustToJSON(r))
+	}
+}
+
+func TestDecodeRunnerOutputLongResult(t *testing.T) {
+	artifact := strings.Repeat("A", 200)
+	output := `{"exitCode":0,"artifacts":[{"name":"a","size":150,"content":"` + artifact + `"}]}` + "\n"
+	events := make(chan *runner.Event)
+	r := decodeRunnerOutput(strings.NewReader(output), 100, 1024, events)
+	if r.Error != "" || len(r.Artifacts) != 1 || r.Artifacts[0].Content != artifact {
+		t.Errorf("expected result longer than the event limit, actual %s", mustToJSON(r))
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 
@@ -21,6 +22,13 @@ func (e HTTPError) Error() string {
 }
 
 func sendError(w http.ResponseWriter, err error) {
+	httpErr := toHTTPError(err)
+	sendJSONWithStatus(w, httpErr.Status, httpErr)
+}
+
+// toHTTPError logs err and converts it to a HTTPError, errors which are not
+// a HTTPError are internal server errors.
+func toHTTPError(err error) HTTPError {
 	httpErr, ok := err.(HTTPError)
 	if !ok {
 		log.Error(err.Error())
@@ -34,8 +42,7 @@ func sendError(w http.ResponseWriter, err error) {
 	if httpErr.Msg == "" {
 		httpErr.Msg = http.StatusText(httpErr.Status)
 	}
-
-	sendJSONWithStatus(w, httpErr.Status, httpErr)
+	return httpErr
 }
 
 func sendJSON(w http.ResponseWriter, v interface{}) {
@@ -71,3 +78,21 @@ func readJSONBody(w http.ResponseWriter, r *http.Request, n int64, v interface{}
 	}
 	return true
 }
+
+// readOptionalJSONBody is like readJSONBody, but leaves v unchanged if the
+// body is empty, which Content-Length does not tell for chunked bodies.
+func readOptionalJSONBody(w http.ResponseWriter, r *http.Request, n int64, v interface{}) (ok bool) {
+	if n > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+	}
+	err := json.NewDecoder(r.Body).Decode(v)
+	switch {
+	case err == nil || err == io.EOF:
+		return true
+	case err.Error() == "http: request body too large":
+		sendError(w, HTTPError{Status: http.StatusRequestEntityTooLarge})
+	default:
+		sendError(w, HTTPError{Status: http.StatusBadRequest, Msg: "Invalid JSON", Reason: err.Error()})
+	}
+	return
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadOptionalJSONBody(t *testing.T) {
+	var bodyTests = []struct {
+		body   string
+		length int64
+		stdin  string
+		status int
+	}{
+		{"", 0, "", http.StatusOK},
+		{"", -1, "", http.StatusOK},
+		{`{"stdin":"x"}`, -1, "x", http.StatusOK},
+		{`{"stdin":"x"}`, 13, "x", http.StatusOK},
+		{`{`, -1, "", http.StatusBadRequest},
+		{`{"stdin":"` + strings.Repeat("x", 100) + `"}`, -1, "", http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range bodyTests {
+		r := httptest.NewRequest("POST", "/snippets/x/run", ioutil.NopCloser(strings.NewReader(tt.body)))
+		r.ContentLength = tt.length
+		w := httptest.NewRecorder()
+		var opts snippetRunOptions
+		ok := readOptionalJSONBody(w, r, 64, &opts)
+		if ok != (tt.status == http.StatusOK) || w.Code != tt.status {
+			t.Errorf("%q: expected status %d, actual %d", tt.body, tt.status, w.Code)
+		}
+		if ok && (opts.Stdin == nil) != (tt.stdin == "") {
+			t.Errorf("%q: unexpected stdin %v", tt.body, opts.Stdin)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/rojul/snip/api/runner"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// jobPollInterval is the interval in which the events of a running job are
+// fetched for GET /runs/{id}/events.
+var jobPollInterval = 500 * time.Millisecond
+
+// jobFlushInterval is the longest time events of a running job are batched
+// before they are stored.
+var jobFlushInterval = 250 * time.Millisecond
+
+const (
+	jobBatchSize = 100
+	// maxJobEventsSize keeps the job documents well below the 16MB limit of
+	// mongo, whatever the RETURN_SIZE_LIMIT is
+	maxJobEventsSize = 8 * 1024 * 1024
+)
+
+// runningJobs holds the cancel functions of the jobs started by this server.
+type runningJobs struct {
+	mu      sync.Mutex
+	cancels map[bson.ObjectId]context.CancelFunc
+}
+
+func newRunningJobs() *runningJobs {
+	return &runningJobs{cancels: map[bson.ObjectId]context.CancelFunc{}}
+}
+
+func (j *runningJobs) add(id bson.ObjectId, cancel context.CancelFunc) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cancels[id] = cancel
+}
+
+func (j *runningJobs) remove(id bson.ObjectId) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.cancels, id)
+}
+
+// cancel reports whether the job was running on this server.
+func (j *runningJobs) cancel(id bson.ObjectId) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	cancel, ok := j.cancels[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+func (h *handler) getJobCollection() *mgo.Collection {
+	return h.getDatabase().C("runs")
+}
+
+// ensureJobIndex lets mongo remove jobs once they are expired.
+func (h *handler) ensureJobIndex() error {
+	return h.getJobCollection().EnsureIndex(mgo.Index{
+		Key:         []string{"expires"},
+		ExpireAfter: time.Second,
+	})
+}
+
+func (h *handler) jobsRouter(r *mux.Router) {
+	r.HandleFunc("", h.createJobHandler).Methods("POST")
+	r.HandleFunc("/{id}", h.getJobHandler).Methods("GET")
+	r.HandleFunc("/{id}", h.deleteJobHandler).Methods("DELETE")
+	r.HandleFunc("/{id}/events", h.getJobEventsHandler).Methods("GET")
+}
+
+func (h *handler) createJobHandler(w http.ResponseWriter, r *http.Request) {
+	var payload Payload
+	if ok := readJSONBody(w, r, h.config.SnippetSizeLimit, &payload); !ok {
+		return
+	}
+
+	language, t, err := h.prepareRun(r, &payload)
+	if err != nil {
+		h.sendRunError(w, err)
+		return
+	}
+
+	payload.noCache = noCacheRequested(r)
+	token, err := newCancelToken()
+	if err != nil {
+		t.release()
+		sendError(w, err)
+		return
+	}
+	job := &Job{
+		ID:          bson.NewObjectId(),
+		Language:    language.ID,
+		Status:      JobRunning,
+		Created:     time.Now(),
+		CancelToken: token,
+	}
+	job.Expires = job.Created.Add(h.config.JobTTL)
+	if err := h.getJobCollection().Insert(job); err != nil {
+		t.release()
+		sendError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.jobs.add(job.ID, cancel)
+	go h.runJob(ctx, job.ID, &payload, language, t)
+
+	w.Header().Set("Location", "/runs/"+job.ID.Hex())
+	sendJSONWithStatus(w, http.StatusAccepted, job)
+}
+
+// runJob stores the events of the run as they arrive and the result at the end.
+func (h *handler) runJob(ctx context.Context, id bson.ObjectId, payload *Payload, language *Language, t *ticket) {
+	defer h.jobs.remove(id)
+	c := h.getJobCollection()
+	events := make(chan *runner.Event)
+	limit := h.config.eventSizeLimit()
+	if limit > maxJobEventsSize {
+		limit = maxJobEventsSize
+	}
+	truncated := make(chan bool)
+	go func() {
+		truncated <- batchEvents(events, limit, func(batch []*runner.Event) {
+			if err := c.UpdateId(id, bson.M{"$push": bson.M{"events": bson.M{"$each": batch}}}); err != nil {
+				log.Error(err.Error())
+			}
+		})
+	}()
+	r, err := h.runContainer(ctx, payload, language, t, events)
+	if <-truncated && err == nil {
+		r.Truncated = true
+	}
+	if err != nil {
+		log.Error(err.Error())
+		r = &runner.Result{Error: http.StatusText(http.StatusInternalServerError)}
+	}
+
+	status := JobDone
+	if ctx.Err() != nil {
+		status = JobCanceled
+	}
+	// a job which was canceled by another server keeps its status
+	err = c.Update(bson.M{"_id": id, "status": JobRunning}, bson.M{"$set": bson.M{"status": status, "result": r}})
+	if err == mgo.ErrNotFound {
+		log.WithField("id", id.Hex()).Debug("run already canceled")
+	} else if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+func newCancelToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// canCancelJob reports whether the request is authorized with the cancel
+// token of the job or the LimitsToken.
+func (h *handler) canCancelJob(r *http.Request, job *Job) bool {
+	if h.canRaiseLimits(r) {
+		return true
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	return job.CancelToken != "" && subtle.ConstantTimeCompare(auth, []byte("Bearer "+job.CancelToken)) == 1
+}
+
+// batchEvents passes the events to push in batches, which are pushed once
+// they are full or jobFlushInterval passed. Events beyond limit bytes are
+// dropped, batchEvents reports whether that happened.
+func batchEvents(events <-chan *runner.Event, limit int64, push func([]*runner.Event)) bool {
+	var batch []*runner.Event
+	var size int64
+	truncated := false
+	flush := time.NewTicker(jobFlushInterval)
+	defer flush.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				if len(batch) > 0 {
+					push(batch)
+				}
+				return truncated
+			}
+			b, err := bson.Marshal(e)
+			if truncated || err != nil || size+int64(len(b)) > limit {
+				truncated = true
+				continue
+			}
+			size += int64(len(b))
+			if batch = append(batch, e); len(batch) >= jobBatchSize {
+				push(batch)
+				batch = nil
+			}
+		case <-flush.C:
+			if len(batch) > 0 {
+				push(batch)
+				batch = nil
+			}
+		}
+	}
+}
+
+func (h *handler) getJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseJobID(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	job, err := h.getJob(id, bson.M{"events": 0, "cancelToken": 0})
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	sendJSON(w, job)
+}
+
+// deleteJobHandler cancels the job. Jobs which are still running but are
+// not known to this server, e.g. after a restart, are marked as canceled.
+func (h *handler) deleteJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseJobID(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	job, err := h.getJob(id, bson.M{"cancelToken": 1})
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	if !h.canCancelJob(r, job) {
+		sendError(w, HTTPErrorInvalidJobToken)
+		return
+	}
+
+	if !h.jobs.cancel(id) {
+		err := h.getJobCollection().Update(
+			bson.M{"_id": id, "status": JobRunning},
+			bson.M{"$set": bson.M{"status": JobCanceled, "result": &runner.Result{Error: "Run canceled"}}},
+		)
+		if err == mgo.ErrNotFound {
+			err = nil
+		}
+		if err != nil {
+			sendError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getJobEventsHandler streams the events following the first after events
+// and the result like /run. The stream ends when the job is finished.
+func (h *handler) getJobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseJobID(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	after, err := eventsAfter(r)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	job, err := h.getJobEvents(id, after)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	s := newStreamWriter(w, r, after)
+	for {
+		for _, e := range job.Events {
+			s.send(string(e.Type), e)
+		}
+		after += len(job.Events)
+		if job.Status != JobRunning {
+			s.send(sseResult, job.Result)
+			return
+		}
+		s.keepAlive()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(jobPollInterval):
+		}
+		if job, err = h.getJobEvents(id, after); err != nil {
+			log.Error(err.Error())
+			return
+		}
+	}
+}
+
+// eventsAfter returns the number of events the client already has. The
+// Last-Event-ID of a reconnecting EventSource takes precedence over the
+// after parameter, as the id of an event is its position.
+func eventsAfter(r *http.Request) (int, error) {
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		after, err := strconv.Atoi(s)
+		if err != nil || after < 0 {
+			return 0, HTTPError{Status: http.StatusBadRequest, Msg: "Invalid Last-Event-ID header"}
+		}
+		return after, nil
+	}
+	if s := r.URL.Query().Get("after"); s != "" {
+		after, err := strconv.Atoi(s)
+		if err != nil || after < 0 {
+			return 0, HTTPError{Status: http.StatusBadRequest, Msg: "Invalid after parameter"}
+		}
+		return after, nil
+	}
+	return 0, nil
+}
+
+// getJobEvents returns the job with the events following the first after events.
+func (h *handler) getJobEvents(id bson.ObjectId, after int) (*Job, error) {
+	return h.getJob(id, bson.M{"events": bson.M{"$slice": []int{after, math.MaxInt32}}, "cancelToken": 0})
+}
+
+func (h *handler) getJob(id bson.ObjectId, selector bson.M) (*Job, error) {
+	var job Job
+	err := h.getJobCollection().FindId(id).Select(selector).One(&job)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, HTTPErrorJobNotFound
+		}
+		return nil, err
+	}
+
+	return &job, nil
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rojul/snip/api/runner"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRunningJobsCancel(t *testing.T) {
+	jobs := newRunningJobs()
+	id := bson.NewObjectId()
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs.add(id, cancel)
+
+	if jobs.cancel(bson.NewObjectId()) {
+		t.Error("expected unknown job not to be canceled")
+	}
+	if !jobs.cancel(id) || ctx.Err() == nil {
+		t.Error("expected job to be canceled")
+	}
+
+	jobs.remove(id)
+	if jobs.cancel(id) {
+		t.Error("expected removed job not to be canceled")
+	}
+}
+
+func TestJobHandlerInvalidID(t *testing.T) {
+	h := newFakeHandler()
+	for _, method := range []string{"GET", "DELETE"} {
+		w := doTestRequest(h, method, "/runs/invalid", "")
+		expectStatus(t, w, HTTPErrorInvalidJobID.Status)
+	}
+}
+
+func TestBatchEvents(t *testing.T) {
+	events := make(chan *runner.Event)
+	go func() {
+		for i := 0; i < jobBatchSize+10; i++ {
+			events <- &runner.Event{Type: runner.Stdout, Message: "x"}
+		}
+		events <- &runner.Event{Type: runner.Stdout, Message: strings.Repeat("x", 1000)}
+		events <- &runner.Event{Type: runner.Stdout, Message: "x"}
+		close(events)
+	}()
+
+	var batches []int
+	truncated := batchEvents(events, 100*1024, func(batch []*runner.Event) {
+		batches = append(batches, len(batch))
+	})
+	if truncated || len(batches) < 2 || batches[0] != jobBatchSize {
+		t.Errorf("unexpected batches %v", batches)
+	}
+
+	events = make(chan *runner.Event)
+	go func() {
+		events <- &runner.Event{Type: runner.Stdout, Message: strings.Repeat("x", 1000)}
+		events <- &runner.Event{Type: runner.Stdout, Message: "x"}
+		close(events)
+	}()
+	var n int
+	truncated = batchEvents(events, 100, func(batch []*runner.Event) { n += len(batch) })
+	if !truncated || n != 0 {
+		t.Errorf("expected events beyond the limit to be dropped, actual %d events", n)
+	}
+}
+
+func TestEventsAfter(t *testing.T) {
+	var tests = []struct {
+		url, lastEventID string
+		after            int
+		ok               bool
+	}{
+		{"/runs/x/events", "", 0, true},
+		{"/runs/x/events?after=3", "", 3, true},
+		{"/runs/x/events?after=3", "7", 7, true},
+		{"/runs/x/events?after=-1", "", 0, false},
+		{"/runs/x/events", "x", 0, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		if tt.lastEventID != "" {
+			r.Header.Set("Last-Event-ID", tt.lastEventID)
+		}
+		after, err := eventsAfter(r)
+		if after != tt.after || (err == nil) != tt.ok {
+			t.Errorf("%s %q: unexpected %d %v", tt.url, tt.lastEventID, after, err)
+		}
+	}
+}
+
+func TestCanCancelJob(t *testing.T) {
+	h := newFakeHandler()
+	h.config.LimitsToken = "admin"
+	token, err := newCancelToken()
+	if err != nil || len(token) != 32 {
+		t.Fatalf("unexpected token %q %v", token, err)
+	}
+	job := &Job{ID: bson.NewObjectId(), CancelToken: token}
+
+	var tests = []struct {
+		auth     string
+		expected bool
+	}{
+		{"", false},
+		{"Bearer wrong", false},
+		{"Bearer " + token, true},
+		{"Bearer admin", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("DELETE", "/runs/"+job.ID.Hex(), nil)
+		r.Header.Set("Authorization", tt.auth)
+		if actual := h.canCancelJob(r, job); actual != tt.expected {
+			t.Errorf("%q: expected %t, actual %t", tt.auth, tt.expected, actual)
+		}
+	}
+	if h.canCancelJob(httptest.NewRequest("DELETE", "/", nil), &Job{}) {
+		t.Error("expected a job without token not to be cancelable without the limits token")
+	}
+}
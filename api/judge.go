@@ -0,0 +1,234 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/rojul/snip/api/runner"
+)
+
+type CompareMode string
+
+const (
+	ExactMode  CompareMode = "exact"
+	TrimMode   CompareMode = "trim"
+	TokensMode CompareMode = "tokens"
+	FloatMode  CompareMode = "float"
+)
+
+const (
+	defaultFloatTolerance = 1e-6
+	maxDiffLines          = 100
+)
+
+type Expected struct {
+	Mode      CompareMode     `json:"mode,omitempty" bson:",omitempty"`
+	Tolerance float64         `json:"tolerance,omitempty" bson:",omitempty"`
+	Cases     []*ExpectedCase `json:"cases"`
+}
+
+type ExpectedCase struct {
+	Stdout   string `json:"stdout"`
+	ExitCode *int   `json:"exitCode,omitempty" bson:",omitempty"`
+}
+
+func (ex *Expected) getValidationError(cases int) error {
+	switch ex.Mode {
+	case "", ExactMode, TrimMode, TokensMode, FloatMode:
+	default:
+		return errors.New("Unknown compare mode " + strconv.Quote(string(ex.Mode)))
+	}
+	if ex.Tolerance < 0 {
+		return errors.New("Tolerance must not be negative")
+	}
+	if cases == 0 {
+		cases = 1
+	}
+	if len(ex.Cases) != cases {
+		return errors.New("Expected " + strconv.Itoa(cases) + " expected cases")
+	}
+	for i, c := range ex.Cases {
+		if c == nil {
+			return errors.New("Expected case " + strconv.Itoa(i+1) + " is null")
+		}
+	}
+	return nil
+}
+
+// judge compares the output of a run with the expected output and returns a
+// verdict for every case. The overall status is the one of the first case
+// which was not accepted.
+func (ex *Expected) judge(res *runner.Result, events []*runner.Event) *runner.Verdict {
+	v := &runner.Verdict{Status: runner.Accepted}
+	if res.Compile != nil && (res.Compile.ExitCode == nil || *res.Compile.ExitCode != 0) {
+		v.Status = runner.CompileError
+		return v
+	}
+	if res.TimedOut {
+		v.Status = runner.TimeLimitExceeded
+		return v
+	}
+
+	phases := res.Cases
+	if len(phases) == 0 {
+		phases = []*runner.PhaseResult{res.Run}
+	}
+	stdouts := make([]string, len(ex.Cases))
+	for _, e := range events {
+		if e.Phase != runner.RunPhase || e.Type != runner.Stdout {
+			continue
+		}
+		i := 0
+		if e.Case != nil {
+			i = *e.Case
+		}
+		if i < len(stdouts) {
+			stdouts[i] += e.Message
+		}
+	}
+
+	for i, c := range ex.Cases {
+		var p *runner.PhaseResult
+		if i < len(phases) {
+			p = phases[i]
+		}
+		cv := ex.judgeCase(c, p, stdouts[i])
+		v.Cases = append(v.Cases, cv)
+		if v.Status == runner.Accepted {
+			v.Status = cv.Status
+		}
+	}
+	return v
+}
+
+func (ex *Expected) judgeCase(c *ExpectedCase, p *runner.PhaseResult, stdout string) *runner.CaseVerdict {
+	if p == nil || p.ExitCode == nil {
+		return &runner.CaseVerdict{Status: runner.RuntimeError}
+	}
+	expectedCode := 0
+	if c.ExitCode != nil {
+		expectedCode = *c.ExitCode
+	}
+	if *p.ExitCode != expectedCode {
+		if *p.ExitCode == 0 {
+			return &runner.CaseVerdict{Status: runner.WrongAnswer}
+		}
+		return &runner.CaseVerdict{Status: runner.RuntimeError}
+	}
+	if !ex.compare(c.Stdout, stdout) {
+		return &runner.CaseVerdict{Status: runner.WrongAnswer, Diff: diffLines(c.Stdout, stdout)}
+	}
+	return &runner.CaseVerdict{Status: runner.Accepted}
+}
+
+func (ex *Expected) compare(expected, actual string) bool {
+	switch ex.Mode {
+	case TrimMode:
+		return trimLines(expected) == trimLines(actual)
+	case TokensMode:
+		return compareTokens(expected, actual, func(a, b string) bool { return a == b })
+	case FloatMode:
+		tol := ex.Tolerance
+		if tol == 0 {
+			tol = defaultFloatTolerance
+		}
+		return compareTokens(expected, actual, func(a, b string) bool { return floatTokenEqual(a, b, tol) })
+	default:
+		return expected == actual
+	}
+}
+
+func trimLines(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t\r")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+func compareTokens(expected, actual string, eq func(a, b string) bool) bool {
+	e, a := strings.Fields(expected), strings.Fields(actual)
+	if len(e) != len(a) {
+		return false
+	}
+	for i := range e {
+		if !eq(e[i], a[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// floatTokenEqual compares two tokens as numbers if both can be parsed,
+// accepting an absolute or relative error of tol.
+func floatTokenEqual(a, b string, tol float64) bool {
+	if a == b {
+		return true
+	}
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	if errA != nil || errB != nil {
+		return false
+	}
+	d := math.Abs(fa - fb)
+	return d <= tol || d <= tol*math.Max(math.Abs(fa), math.Abs(fb))
+}
+
+// diffLines returns a line based diff of the expected and the actual output.
+// Lines only in expected are prefixed with "-", lines only in actual with "+".
+func diffLines(expected, actual string) string {
+	e, a := strings.Split(expected, "\n"), strings.Split(actual, "\n")
+	if len(e)*len(a) > 1000000 {
+		return "- " + strings.Join(e[:min(len(e), maxDiffLines)], "\n- ") +
+			"\n+ " + strings.Join(a[:min(len(a), maxDiffLines)], "\n+ ")
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of e[i:] and a[j:]
+	lcs := make([][]int, len(e)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(a)+1)
+	}
+	for i := len(e) - 1; i >= 0; i-- {
+		for j := len(a) - 1; j >= 0; j-- {
+			if e[i] == a[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for (i < len(e) || j < len(a)) && len(out) < maxDiffLines {
+		switch {
+		case i < len(e) && j < len(a) && e[i] == a[j]:
+			out = append(out, "  "+e[i])
+			i++
+			j++
+		case i < len(e) && (j == len(a) || lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "- "+e[i])
+			i++
+		default:
+			out = append(out, "+ "+a[j])
+			j++
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
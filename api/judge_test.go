@@ -0,0 +1,87 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/rojul/snip/api/runner"
+)
+
+func TestCompare(t *testing.T) {
+	var compareTests = []struct {
+		mode     CompareMode
+		expected string
+		actual   string
+		equal    bool
+	}{
+		{ExactMode, "1 2\n", "1 2\n", true},
+		{ExactMode, "1 2\n", "1 2 \n", false},
+		{TrimMode, "1 2\n", "1 2  \n\n", true},
+		{TrimMode, "1 2\n", " 1 2\n", false},
+		{TokensMode, "1 2\n", " 1\n 2", true},
+		{TokensMode, "1 2\n", "1 2 3", false},
+		{FloatMode, "0.3333333", "0.33333334", true},
+		{FloatMode, "1e9", "1000000000.5", true},
+		{FloatMode, "0.5", "0.51", false},
+		{FloatMode, "yes 1.0", "yes 1", true},
+	}
+
+	for _, tt := range compareTests {
+		ex := &Expected{Mode: tt.mode}
+		if actual := ex.compare(tt.expected, tt.actual); actual != tt.equal {
+			t.Errorf("%s %q %q: expected %v, actual %v", tt.mode, tt.expected, tt.actual, tt.equal, actual)
+		}
+	}
+}
+
+func TestJudge(t *testing.T) {
+	zero, one := 0, 1
+	stdout := func(c int, msg string) *runner.Event {
+		return &runner.Event{Type: runner.Stdout, Phase: runner.RunPhase, Case: &c, Message: msg}
+	}
+	ex := &Expected{Cases: []*ExpectedCase{{Stdout: "2\n"}, {Stdout: "4\n"}, {Stdout: "6\n"}}}
+
+	var judgeTests = []struct {
+		result   *runner.Result
+		events   []*runner.Event
+		expected []runner.VerdictStatus
+	}{
+		{
+			&runner.Result{Cases: []*runner.PhaseResult{{ExitCode: &zero}, {ExitCode: &zero}, {ExitCode: &zero}}},
+			[]*runner.Event{stdout(0, "2\n"), stdout(1, "4"), stdout(1, "\n"), stdout(2, "6\n")},
+			[]runner.VerdictStatus{runner.Accepted, runner.Accepted, runner.Accepted, runner.Accepted},
+		},
+		{
+			&runner.Result{Cases: []*runner.PhaseResult{{ExitCode: &zero}, {ExitCode: &one}, {ExitCode: &zero}}},
+			[]*runner.Event{stdout(0, "2\n"), stdout(2, "7\n")},
+			[]runner.VerdictStatus{runner.RuntimeError, runner.Accepted, runner.RuntimeError, runner.WrongAnswer},
+		},
+		{
+			&runner.Result{Compile: &runner.PhaseResult{ExitCode: &one}},
+			nil,
+			[]runner.VerdictStatus{runner.CompileError},
+		},
+		{
+			&runner.Result{TimedOut: true},
+			nil,
+			[]runner.VerdictStatus{runner.TimeLimitExceeded},
+		},
+	}
+
+	for i, tt := range judgeTests {
+		v := ex.judge(tt.result, tt.events)
+		actual := []runner.VerdictStatus{v.Status}
+		for _, c := range v.Cases {
+			actual = append(actual, c.Status)
+		}
+		if mustToJSON(actual) != mustToJSON(tt.expected) {
+			t.Errorf("test %d: expected %v, actual %v", i, tt.expected, actual)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	expected := "  a\n- b\n+ B\n  c"
+	if actual := diffLines("a\nb\nc", "a\nB\nc"); actual != expected {
+		t.Errorf("expected %q, actual %q", expected, actual)
+	}
+}
@@ -58,8 +58,12 @@ func (h *handler) languageHandler(w http.ResponseWriter, r *http.Request) {
 			ID:          l.ID,
 			Name:        l.Name,
 			Extension:   l.Extension,
-			Command:     l.Command,
+			Compile:     l.Compile,
+			Run:         l.Run,
+			Command:     l.command(),
 			NotRunnable: l.NotRunnable,
+			Network:     l.Network,
+			Limits:      l.Limits,
 		},
 		HelloWorld: l.getTestPayload("helloWorld"),
 	})
@@ -99,6 +103,9 @@ func loadLanguagesJson(file string) ([]*Language, error) {
 		if l.Extension == "" {
 			l.Extension = l.ID
 		}
+		if l.Run == "" {
+			l.Run = l.Command
+		}
 		if _, ok := l.Tests["helloWorld"]; !ok {
 			if l.Tests == nil {
 				l.Tests = map[string]LanguageTest{}
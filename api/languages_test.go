@@ -1,8 +1,12 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"io/ioutil"
+	"os"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/rojul/snip/api/runner"
@@ -33,6 +37,31 @@ func TestLanguageTests(t *testing.T) {
 	}
 }
 
+func TestLanguageDeprecatedCommand(t *testing.T) {
+	f, err := ioutil.TempFile("", "languages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"languages":[{"id":"ash","command":"sh $FILE"}]}`)
+	f.Close()
+
+	ls, err := loadLanguagesJson(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ls[0].Run != "sh $FILE" {
+		t.Errorf("expected command to be used as run, actual %q", ls[0].Run)
+	}
+
+	h := newFakeHandler()
+	h.languages = []*Language{{ID: "c", Extension: "c", Compile: "gcc $FILE", Run: "./a.out"}}
+	w := doTestRequest(h, "GET", "/languages/c", "")
+	if !strings.Contains(w.Body.String(), `"command":"gcc $FILE \u0026\u0026 ./a.out"`) {
+		t.Errorf("expected a deprecated command, actual %s", w.Body.String())
+	}
+}
+
 func testLanguageTest(t *testing.T, l *Language, name string) {
 	if l.NotRunnable {
 		t.Skip("not runnable")
@@ -45,13 +74,14 @@ func testLanguageTest(t *testing.T, l *Language, name string) {
 	if stdout == "" {
 		stdout = "Hello World\n"
 	}
-	r, err := testH.runContainerSync(p, l)
+	stderr := l.Tests[name]["_stderr"]
+	r, err := testH.runContainerSync(context.Background(), p, l)
 	if err != nil {
 		t.Fatal(err)
 	}
 	rJSON := mustToJSON(r)
-	if !compareResult(r, stdout) {
-		t.Fatalf("\nexpected: %#v\nactual:   %s", stdout, rJSON)
+	if !compareResult(r, stdout, stderr) {
+		t.Fatalf("\nexpected: %#v %#v\nactual:   %s", stdout, stderr, rJSON)
 	}
 	if *verbose {
 		t.Logf("ok: %s", rJSON)
@@ -74,15 +104,20 @@ func mustToJSON(v interface{}) string {
 	return string(b)
 }
 
-func compareResult(r *runner.Result, stdout string) bool {
-	rStdout := ""
+func compareResult(r *runner.Result, stdout, stderr string) bool {
+	rStdout, rStderr := "", ""
 	for _, e := range r.Events {
+		if e.Phase == runner.CompilePhase {
+			continue
+		}
 		switch e.Type {
 		case runner.Stdout:
 			rStdout += e.Message
+		case runner.Stderr:
+			rStderr += e.Message
 		default:
 			return false
 		}
 	}
-	return r.ExitCode != nil && *r.ExitCode == 0 && r.Error == "" && rStdout == stdout
+	return r.ExitCode != nil && *r.ExitCode == 0 && r.Error == "" && rStdout == stdout && rStderr == stderr
 }
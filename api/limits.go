@@ -0,0 +1,254 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/rojul/snip/api/runner"
+)
+
+// maxCPUs is the most cpus a limit can have, which also keeps the NanoCPUs
+// from overflowing.
+const maxCPUs = 1024
+
+// The smallest limits, docker refuses to start containers with less memory
+// or cpus.
+const (
+	minMemory  = 4 * units.MiB
+	minCPUs    = 0.01
+	minTimeout = 100 * time.Millisecond
+)
+
+// ByteSize is a number of bytes which is written with units, e.g. "512m".
+type ByteSize int64
+
+func (b ByteSize) MarshalText() ([]byte, error) {
+	for _, u := range []struct {
+		suffix string
+		n      int64
+	}{{"g", units.GiB}, {"m", units.MiB}, {"k", units.KiB}} {
+		if b != 0 && int64(b)%u.n == 0 {
+			return []byte(strconv.FormatInt(int64(b)/u.n, 10) + u.suffix), nil
+		}
+	}
+	return []byte(strconv.FormatInt(int64(b), 10)), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	n, err := units.RAMInBytes(string(text))
+	if err == nil && n < 0 {
+		err = errors.New("invalid size: " + string(text))
+	}
+	*b = ByteSize(n)
+	return err
+}
+
+// Duration is a time.Duration which is written like "30s".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	*d = Duration(v)
+	return err
+}
+
+// Limits overrides the resource limits of the config. Zero values keep the
+// limit of the config.
+type Limits struct {
+	Memory  ByteSize `json:"memory,omitempty" toml:"memory"`
+	CPUs    float64  `json:"cpus,omitempty" toml:"cpus"`
+	Pids    int64    `json:"pids,omitempty" toml:"pids"`
+	Timeout Duration `json:"timeout,omitempty" toml:"timeout"`
+}
+
+func (l *Limits) getValidationError() error {
+	if l.Memory < 0 || l.CPUs < 0 || l.Pids < 0 || l.Timeout < 0 {
+		return errors.New("Limits can not be negative")
+	}
+	if math.IsNaN(l.CPUs) || l.CPUs > maxCPUs {
+		return errors.New("Too many cpus")
+	}
+	if l.Memory > 0 && l.Memory < minMemory {
+		return errors.New("Memory must be at least 4m")
+	}
+	if l.CPUs > 0 && l.CPUs < minCPUs {
+		return errors.New("Cpus must be at least 0.01")
+	}
+	if l.Timeout > 0 && time.Duration(l.Timeout) < minTimeout {
+		return errors.New("Timeout must be at least 100ms")
+	}
+	return nil
+}
+
+// getMaxError returns an error if the limits exceed the maximums of the
+// config, which would otherwise clamp them silently at run time.
+func (c *Config) getMaxError(l *Limits) error {
+	if err := l.getValidationError(); err != nil {
+		return err
+	}
+	switch {
+	case c.MaxMemory > 0 && int64(l.Memory) > c.MaxMemory:
+		return errors.New("Memory exceeds MAX_MEMORY")
+	case c.MaxNanoCPUs > 0 && l.CPUs*1e9 > float64(c.MaxNanoCPUs):
+		return errors.New("Cpus exceed MAX_NANO_CPUS")
+	case c.MaxPidsLimit > 0 && l.Pids > c.MaxPidsLimit:
+		return errors.New("Pids exceed MAX_PIDS_LIMIT")
+	case c.MaxRunTimeout > 0 && time.Duration(l.Timeout) > c.MaxRunTimeout:
+		return errors.New("Timeout exceeds MAX_RUN_TIMEOUT")
+	}
+	return nil
+}
+
+// ValidateLanguageLimits returns an error if the limits of the language are
+// invalid or exceed the maximums of the config from the environment.
+func ValidateLanguageLimits(l *Language) error {
+	if l.Limits == nil {
+		return nil
+	}
+	c, err := configFromEnv()
+	if err != nil {
+		return err
+	}
+	return c.getMaxError(l.Limits)
+}
+
+// RunLimits are the limits a payload can request.
+type RunLimits struct {
+	Memory  ByteSize `json:"memory,omitempty"`
+	CPUs    float64  `json:"cpus,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+func (l *RunLimits) limits() *Limits {
+	return &Limits{Memory: l.Memory, CPUs: l.CPUs, Timeout: l.Timeout}
+}
+
+func (l *RunLimits) getValidationError() error {
+	return l.limits().getValidationError()
+}
+
+// Resources are the effective limits of a run. A zero Memory, NanoCPUs or
+// PidsLimit means unlimited.
+type Resources struct {
+	Memory    int64
+	NanoCPUs  int64
+	PidsLimit int64
+	Timeout   time.Duration
+	Network   string
+}
+
+func (r Resources) runnerLimits() *runner.Limits {
+	return &runner.Limits{
+		Timeout: int64(r.Timeout / time.Millisecond),
+		Memory:  r.Memory,
+		CPUs:    float64(r.NanoCPUs) / 1e9,
+		Pids:    r.PidsLimit,
+		Network: r.Network,
+	}
+}
+
+// lower returns the resources with the limits which are stricter than them.
+func (r Resources) lower(l *Limits) Resources {
+	if m := int64(l.Memory); m > 0 && (r.Memory <= 0 || m < r.Memory) {
+		r.Memory = m
+	}
+	if n := int64(l.CPUs * 1e9); n > 0 && (r.NanoCPUs <= 0 || n < r.NanoCPUs) {
+		r.NanoCPUs = n
+	}
+	if t := time.Duration(l.Timeout); t > 0 && t < r.Timeout {
+		r.Timeout = t
+	}
+	return r
+}
+
+// runResources returns the resources of a run of the payload. The limits of
+// the payload can only be stricter than the ones of the language, unless
+// the request was allowed to raise them.
+func (h *handler) runResources(payload *Payload, language *Language) Resources {
+	res := h.config.resources(language.Limits)
+	if payload.Limits == nil {
+		return res
+	}
+	if payload.raiseLimits {
+		return h.config.resources(language.Limits, payload.Limits.limits())
+	}
+	return res.lower(payload.Limits.limits())
+}
+
+// canRaiseLimits reports whether the request is authorized with the
+// LimitsToken to raise limits.
+func (h *handler) canRaiseLimits(r *http.Request) bool {
+	if h.config.LimitsToken == "" {
+		return false
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(auth, []byte("Bearer "+h.config.LimitsToken)) == 1
+}
+
+// resources merges the limits into the limits of the config, later limits
+// take precedence. The limits are clamped to the maximums of the config,
+// the limits of the config itself are checked at startup.
+func (c *Config) resources(limits ...*Limits) Resources {
+	res := Resources{
+		Memory:    c.Memory,
+		NanoCPUs:  c.NanoCPUs,
+		PidsLimit: c.PidsLimit,
+		Timeout:   c.RunTimeout,
+		Network:   networkNone,
+	}
+	if c.NetworkEnabled {
+		res.Network = networkFull
+	}
+	for _, l := range limits {
+		if l == nil {
+			continue
+		}
+		if l.Memory > 0 {
+			res.Memory = clampLimit(int64(l.Memory), c.MaxMemory)
+		}
+		if l.CPUs > 0 {
+			res.NanoCPUs = clampLimit(int64(l.CPUs*1e9), c.MaxNanoCPUs)
+		}
+		if l.Pids > 0 {
+			res.PidsLimit = clampLimit(l.Pids, c.MaxPidsLimit)
+		}
+		if l.Timeout > 0 {
+			res.Timeout = time.Duration(clampLimit(int64(l.Timeout), int64(c.MaxRunTimeout)))
+		}
+	}
+	return res
+}
+
+// maxRunTimeout is the longest timeout a run can have. Without a
+// MaxRunTimeout the timeout requested by a payload is not limited and
+// may exceed it.
+func (h *handler) maxRunTimeout() time.Duration {
+	max := h.config.resources().Timeout
+	for _, l := range h.languages {
+		if t := h.config.resources(l.Limits).Timeout; t > max {
+			max = t
+		}
+	}
+	if h.config.MaxRunTimeout > max {
+		max = h.config.MaxRunTimeout
+	}
+	return max
+}
+
+// clampLimit returns max if v is above max. A max of zero means there is no
+// maximum.
+func clampLimit(v, max int64) int64 {
+	if max > 0 && v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+func TestConfigResources(t *testing.T) {
+	c := defaultConfig()
+	c.MaxMemory = units.GiB
+	c.MaxNanoCPUs = 2e9
+	c.MaxRunTimeout = time.Minute
+
+	res := c.resources()
+	if res.Memory != c.Memory || res.NanoCPUs != 0 || res.PidsLimit != c.PidsLimit || res.Timeout != c.RunTimeout {
+		t.Errorf("expected limits of the config, actual %+v", res)
+	}
+
+	res = c.resources(
+		&Limits{Memory: ByteSize(2 * units.GiB), Pids: 10, Timeout: Duration(time.Hour)},
+		nil,
+		&Limits{Pids: 20, CPUs: 0.5},
+	)
+	expected := Resources{Memory: units.GiB, NanoCPUs: 5e8, PidsLimit: 20, Timeout: c.MaxRunTimeout, Network: networkNone}
+	if res != expected {
+		t.Errorf("expected %+v, actual %+v", expected, res)
+	}
+}
+
+func TestConfigMaxError(t *testing.T) {
+	c := defaultConfig()
+	c.MaxMemory = 2 * units.GiB
+	c.MaxNanoCPUs = 2e9
+	c.MaxPidsLimit = 256
+	c.MaxRunTimeout = time.Minute
+	for _, l := range []*Limits{
+		{Memory: ByteSize(c.MaxMemory + 1)},
+		{CPUs: 2.5},
+		{Pids: c.MaxPidsLimit + 1},
+		{Timeout: Duration(c.MaxRunTimeout + time.Second)},
+		{Pids: -1},
+	} {
+		if c.getMaxError(l) == nil {
+			t.Errorf("expected error for %+v", l)
+		}
+	}
+	if err := c.getMaxError(&Limits{Memory: ByteSize(c.MaxMemory), CPUs: 2, Pids: 10, Timeout: Duration(c.MaxRunTimeout)}); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestResourcesLower(t *testing.T) {
+	c := defaultConfig()
+	res := c.resources().lower(&Limits{Memory: ByteSize(units.GiB), CPUs: 0.5, Timeout: Duration(time.Second)})
+	if res.Memory != c.Memory || res.NanoCPUs != 5e8 || res.Timeout != time.Second {
+		t.Errorf("expected only stricter limits, actual %+v", res)
+	}
+}
+
+func TestLimitsJSON(t *testing.T) {
+	var l Limits
+	if err := json.Unmarshal([]byte(`{"memory":"1g","timeout":"30s"}`), &l); err != nil {
+		t.Fatal(err)
+	}
+	if l.Memory != ByteSize(units.GiB) || l.Timeout != Duration(30*time.Second) {
+		t.Errorf("unexpected limits %+v", l)
+	}
+	if s := mustToJSON(&Limits{Memory: ByteSize(1536 * units.MiB), Pids: 5}); s != `{"memory":"1536m","pids":5}` {
+		t.Errorf("unexpected json %s", s)
+	}
+	if err := json.Unmarshal([]byte(`{"memory":"lots"}`), &l); err == nil {
+		t.Error("expected error for invalid memory")
+	}
+}
+
+func TestLimitsMinimums(t *testing.T) {
+	min := &Limits{Memory: ByteSize(minMemory), CPUs: minCPUs, Timeout: Duration(minTimeout)}
+	if err := min.getValidationError(); err != nil {
+		t.Error(err)
+	}
+	for _, l := range []*Limits{
+		{Memory: ByteSize(units.KiB)},
+		{CPUs: 0.001},
+		{Timeout: Duration(time.Millisecond)},
+	} {
+		if l.getValidationError() == nil {
+			t.Errorf("expected error for %+v", l)
+		}
+	}
+}
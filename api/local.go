@@ -0,0 +1,34 @@
+package api
+
+import (
+	"os"
+)
+
+// localRunnerEnv is set by the local executor when it starts the current
+// binary again to run the runner. It contains the JSON encoded options.
+const localRunnerEnv = "SNIP_LOCAL_RUNNER"
+
+// localSandboxID is the uid and gid of the runner inside the sandbox of the
+// local executor.
+const localSandboxID = 1000
+
+// localWorkDir is the working directory of the runner inside the sandbox.
+const localWorkDir = "/work"
+
+type localRunnerOptions struct {
+	Dir        string   `json:"dir"`
+	Binds      []string `json:"binds"`
+	Memory     int64    `json:"memory"`
+	PidsLimit  int64    `json:"pidsLimit"`
+	CPUSeconds uint64   `json:"cpuSeconds"`
+	Rootless   bool     `json:"rootless,omitempty"`
+	// Sandboxed is set for the second stage, which runs the runner as an
+	// unprivileged user after the first stage set up the sandbox
+	Sandboxed bool `json:"sandboxed,omitempty"`
+}
+
+// IsLocalRunner reports whether the process was started by the local
+// executor and should call RunLocalRunner instead of serving the API.
+func IsLocalRunner() bool {
+	return os.Getenv(localRunnerEnv) != ""
+}
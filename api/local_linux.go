@@ -0,0 +1,446 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rojul/snip/api/runner"
+)
+
+// rlimitNproc is RLIMIT_NPROC, which is missing in package syscall
+const rlimitNproc = 6
+
+// flags of statfs, which are missing in package syscall
+const (
+	stNoexec     = 8
+	stNoatime    = 1024
+	stNodiratime = 2048
+	stRelatime   = 4096
+)
+
+// localDevices are bound into the sandbox.
+var localDevices = []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+
+// localExecutor runs the runner in a child process of the API, without
+// docker. The child is started in new user, mount, pid, network, ipc and uts
+// namespaces. Its root directory is a tmpfs which only contains read-only
+// binds of the toolchain from LocalBinds. Root inside the sandbox is mapped
+// to LocalIDBase and the runner itself runs with the id LocalIDBase+1+slot,
+// which is unique per concurrent run, so RLIMIT_NPROC only counts the
+// processes of the run. Mapping these ids requires the API to run as root.
+// Otherwise the executor is rootless: only root inside the sandbox is mapped,
+// to the user running the API, and the runner gets a nested user namespace in
+// which it is the sandbox user. Runs then share the host id, so older kernels
+// count the processes of the user running the API against RLIMIT_NPROC.
+// There is no seccomp filter.
+type localExecutor struct {
+	config   *Config
+	binds    []string
+	rootless bool
+	mu       sync.Mutex
+	slots    map[int]bool
+}
+
+func newLocalExecutor(config *Config) (Executor, error) {
+	if config.NetworkEnabled {
+		return nil, errors.New("the local executor does not support NETWORK_ENABLED")
+	}
+	e := &localExecutor{config: config, rootless: os.Geteuid() != 0, slots: map[int]bool{}}
+	if e.rootless {
+		log.Warn("the local executor is not running as root, the runs share the id of the current user")
+	}
+	for _, b := range strings.Split(config.LocalBinds, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			e.binds = append(e.binds, filepath.Clean(b))
+		}
+	}
+	return e, nil
+}
+
+// acquireSlot returns the lowest slot which is not used by a running run.
+func (e *localExecutor) acquireSlot() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	slot := 0
+	for e.slots[slot] {
+		slot++
+	}
+	e.slots[slot] = true
+	return slot
+}
+
+func (e *localExecutor) releaseSlot(slot int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.slots, slot)
+}
+
+func (e *localExecutor) idMappings(slot int, currentID int) []syscall.SysProcIDMap {
+	if e.rootless {
+		return []syscall.SysProcIDMap{{ContainerID: 0, HostID: currentID, Size: 1}}
+	}
+	return []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: e.config.LocalIDBase, Size: 1},
+		{ContainerID: localSandboxID, HostID: e.config.LocalIDBase + 1 + slot, Size: 1},
+	}
+}
+
+func (e *localExecutor) Execute(ctx context.Context, payload *runner.Payload, language *Language, resources Resources, stdin io.Reader, events chan<- *runner.Event) (*runner.Result, error) {
+	defer close(events)
+	if resources.Network == networkAllowlist {
+		return &runner.Result{Error: "Network access is not supported by the local executor"}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, resources.Timeout)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "snip-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	slot := e.acquireSlot()
+	defer e.releaseSlot(slot)
+	cmd, stdout, err := e.start(dir, payloadBytes, resources, stdin, slot)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"pid":      cmd.Process.Pid,
+		"language": language.ID,
+	}).Debug("local runner started")
+
+	exited := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// kills the whole pid namespace
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+
+	result := decodeRunnerOutput(stdout, e.config.eventSizeLimit(), e.config.runnerLineLimit(), events)
+	cmd.Wait()
+	close(exited)
+
+	if stderr := cmd.Stderr.(*bytes.Buffer).String(); stderr != "" {
+		return &runner.Result{Error: "Runner returned an error:\n\n" + stderr}, nil
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return &runner.Result{Error: "Runner timed out", TimedOut: true, Output: result.Output, Truncated: result.Truncated}, nil
+	}
+	if result.IsEmpty() {
+		result.Error = "No response from runner"
+	}
+
+	return result, nil
+}
+
+func (e *localExecutor) start(dir string, payload []byte, resources Resources, stdin io.Reader, slot int) (*exec.Cmd, io.Reader, error) {
+	opts, err := json.Marshal(&localRunnerOptions{
+		Dir:        dir,
+		Binds:      e.binds,
+		Memory:     resources.Memory,
+		PidsLimit:  resources.PidsLimit,
+		CPUSeconds: uint64((resources.Timeout + time.Second - 1) / time.Second),
+		Rootless:   e.rootless,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the binary may not be accessible by the mapped root, but the link is
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		localRunnerEnv + "=" + string(opts),
+	}
+	cmd.Stderr = &bytes.Buffer{}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings: e.idMappings(slot, os.Getuid()),
+		GidMappings: e.idMappings(slot, os.Getgid()),
+		// an unprivileged process can only map its gid if setgroups is denied
+		GidMappingsEnableSetgroups: !e.rootless,
+		// becomes root of the user namespace, so it can set up the sandbox
+		Credential: &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: e.rootless},
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	// cmd.Stdin is not used for the payload, Wait would block until an
+	// interactive stdin is closed even if the runner already exited
+	pw, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		pw.Write(payload)
+		if stdin != nil {
+			io.Copy(pw, stdin)
+		}
+		pw.Close()
+	}()
+	return cmd, stdout, nil
+}
+
+// RunLocalRunner prepares the sandbox of the local executor and runs the
+// runner in it. It must only be called if IsLocalRunner returns true.
+func RunLocalRunner() {
+	runtime.GOMAXPROCS(1)
+
+	var opts localRunnerOptions
+	if err := json.Unmarshal([]byte(os.Getenv(localRunnerEnv)), &opts); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid options: "+err.Error())
+		os.Exit(1)
+	}
+
+	if !opts.Sandboxed {
+		os.Exit(runSandbox(&opts))
+	}
+
+	os.Unsetenv(localRunnerEnv)
+	if err := setRlimits(&opts); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	runner.Run(os.Stdin, os.Stdout)
+}
+
+// runSandbox is the first stage, which runs as root of the user namespace.
+// It sets up the sandbox and starts the second stage in it as unprivileged
+// user. It returns the exit code of the second stage.
+func runSandbox(opts *localRunnerOptions) int {
+	if err := setupSandbox(opts); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	opts.Sandboxed = true
+	b, err := json.Marshal(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Dir = localWorkDir
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + localWorkDir,
+		localRunnerEnv + "=" + string(b),
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig:  syscall.SIGKILL,
+		Credential: &syscall.Credential{Uid: localSandboxID, Gid: localSandboxID},
+	}
+	if opts.Rootless {
+		// the sandbox user is not mapped, so it is mapped to root in a nested
+		// user namespace, in which the runner has no capabilities
+		ids := []syscall.SysProcIDMap{{ContainerID: localSandboxID, HostID: 0, Size: 1}}
+		cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = ids
+		cmd.SysProcAttr.GidMappings = ids
+		cmd.SysProcAttr.Credential.NoSetGroups = true
+	}
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			fmt.Fprintln(os.Stderr, "starting runner failed: "+err.Error())
+		}
+		return 1
+	}
+	return 0
+}
+
+// setupSandbox mounts a tmpfs at opts.Dir with the binds, devices, /proc,
+// /tmp and the working directory, and makes it the root directory.
+func setupSandbox(opts *localRunnerOptions) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private failed: %v", err)
+	}
+	root := opts.Dir
+	tmpfsOpts := "mode=0755"
+	if opts.Memory > 0 {
+		tmpfsOpts += ",size=" + strconv.FormatInt(opts.Memory, 10)
+	}
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, tmpfsOpts); err != nil {
+		return fmt.Errorf("mounting tmpfs failed: %v", err)
+	}
+
+	for _, src := range opts.Binds {
+		if err := bindMount(src, filepath.Join(root, src), true); err != nil {
+			return fmt.Errorf("binding %s failed: %v", src, err)
+		}
+	}
+	for _, dev := range localDevices {
+		if err := bindMount(dev, filepath.Join(root, dev), false); err != nil {
+			return fmt.Errorf("binding %s failed: %v", dev, err)
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(root, "proc"), 0555); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", filepath.Join(root, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc failed: %v", err)
+	}
+	if err := mkdir(filepath.Join(root, "tmp"), os.ModeSticky|0777, 0); err != nil {
+		return err
+	}
+	owner := localSandboxID
+	if opts.Rootless {
+		owner = 0
+	}
+	if err := mkdir(filepath.Join(root, localWorkDir), 0755, owner); err != nil {
+		return err
+	}
+
+	old := filepath.Join(root, ".old")
+	if err := os.Mkdir(old, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, old); err != nil {
+		return fmt.Errorf("pivot_root failed: %v", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.old", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmounting the old root failed: %v", err)
+	}
+	return os.Remove("/.old")
+}
+
+// mkdir creates the directory with exactly mode, ignoring the umask.
+func mkdir(path string, mode os.FileMode, owner int) error {
+	if err := os.Mkdir(path, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	return os.Chown(path, owner, owner)
+}
+
+// bindMount binds src to dst, which is created first. Symbolic links are
+// copied instead. Sources which do not exist are skipped.
+func bindMount(src, dst string, readOnly bool) error {
+	fi, err := os.Lstat(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case fi.IsDir():
+		err = os.Mkdir(dst, 0755)
+	default:
+		var f *os.File
+		if f, err = os.Create(dst); err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	if !readOnly {
+		return nil
+	}
+	locked, err := lockedMountFlags(dst)
+	if err != nil {
+		return err
+	}
+	flags := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | locked
+	return syscall.Mount("", dst, "", flags, "")
+}
+
+// lockedMountFlags returns the flags of the mount at path which can not be
+// cleared in a user namespace, so a remount has to keep them.
+func lockedMountFlags(path string) (uintptr, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	var flags uintptr
+	for _, f := range []struct {
+		st int64
+		ms uintptr
+	}{
+		{stNoexec, syscall.MS_NOEXEC},
+		{stNoatime, syscall.MS_NOATIME},
+		{stNodiratime, syscall.MS_NODIRATIME},
+		{stRelatime, syscall.MS_RELATIME},
+	} {
+		if int64(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	return flags, nil
+}
+
+// setRlimits sets the limits of the runner. RLIMIT_DATA is used instead of
+// RLIMIT_AS, as the latter also limits the address space the go runtime has
+// already reserved.
+func setRlimits(opts *localRunnerOptions) error {
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_DATA, uint64(opts.Memory)},
+		{rlimitNproc, uint64(opts.PidsLimit)},
+		{syscall.RLIMIT_CPU, opts.CPUSeconds},
+		{syscall.RLIMIT_CORE, 0},
+	}
+	for _, l := range limits {
+		if l.value == 0 && l.resource != syscall.RLIMIT_CORE {
+			continue
+		}
+		if err := syscall.Setrlimit(l.resource, &syscall.Rlimit{Cur: l.value, Max: l.value}); err != nil {
+			return fmt.Errorf("setting rlimit %d failed: %v", l.resource, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rojul/snip/api/runner"
+)
+
+func newTestLocalExecutor(t *testing.T) *localExecutor {
+	e, err := newLocalExecutor(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.(*localExecutor)
+}
+
+func executeScript(t *testing.T, e Executor, script string) (*runner.Result, string) {
+	payload := &runner.Payload{
+		Files:   []*runner.File{{Name: "main.sh", Content: script}},
+		Command: "sh main.sh",
+	}
+	events := make(chan *runner.Event)
+	done := make(chan string)
+	go func() {
+		var stdout string
+		for e := range events {
+			if e.Type == runner.Stdout {
+				stdout += e.Message
+			}
+		}
+		done <- stdout
+	}()
+	r, err := e.Execute(context.Background(), payload, &Language{ID: "ash"}, defaultConfig().resources(), nil, events)
+	stdout := <-done
+	if err != nil {
+		if os.IsPermission(err) {
+			t.Skip("namespaces are not available: " + err.Error())
+		}
+		t.Fatal(err)
+	}
+	return r, stdout
+}
+
+func TestLocalExecutorSandbox(t *testing.T) {
+	testLocalExecutorSandbox(t, newTestLocalExecutor(t))
+}
+
+func TestLocalExecutorRootless(t *testing.T) {
+	e := newTestLocalExecutor(t)
+	e.rootless = true
+	testLocalExecutorSandbox(t, e)
+}
+
+func testLocalExecutorSandbox(t *testing.T, e *localExecutor) {
+	probe := "/root/snip-probe"
+	os.Remove(probe)
+
+	r, stdout := executeScript(t, e, `
+		echo hello > file && cat file && pwd && id -u
+		cat /etc/shadow /etc/passwd && echo "read /etc"
+		touch `+probe+` && echo "wrote `+probe+`"
+		touch /usr/probe && echo "wrote /usr"
+		ls /proc | grep -c '^[0-9]'
+	`)
+	if r.Error != "" {
+		t.Fatalf("unexpected error: %s", r.Error)
+	}
+	expected := "hello\n" + localWorkDir + "\n1000\n"
+	if !strings.HasPrefix(stdout, expected) {
+		t.Errorf("expected stdout to start with %q, actual %q", expected, stdout)
+	}
+	for _, s := range []string{"read /etc", "wrote"} {
+		if strings.Contains(stdout, s) {
+			t.Errorf("sandbox escaped: %q", stdout)
+		}
+	}
+	if _, err := os.Stat(probe); err == nil {
+		os.Remove(probe)
+		t.Errorf("%s was written by the sandbox", probe)
+	}
+	// sh, ls and grep are the only processes besides the runner
+	if lines := strings.Split(strings.TrimSpace(stdout), "\n"); len(lines[len(lines)-1]) > 1 {
+		t.Errorf("host processes are visible: %q", stdout)
+	}
+}
+
+func TestLocalExecutorPidsLimit(t *testing.T) {
+	e := newTestLocalExecutor(t)
+	if e.rootless {
+		t.Skip("RLIMIT_NPROC also counts the processes of the user running the tests")
+	}
+	// RLIMIT_NPROC only counts the processes of the run, not the ones of
+	// the user running the tests
+	r, stdout := executeScript(t, e, `sleep 1 & sleep 1 & wait; echo done`)
+	if r.Error != "" || stdout != "done\n" {
+		t.Errorf("unexpected result: %s %q", mustToJSON(r), stdout)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package api
+
+import (
+	"errors"
+	"os"
+)
+
+func newLocalExecutor(config *Config) (Executor, error) {
+	return nil, errors.New("the local executor is only supported on linux")
+}
+
+func RunLocalRunner() {
+	os.Exit(1)
+}
@@ -1,12 +1,18 @@
 package api
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
-	"github.com/docker/docker/client"
+	"github.com/rojul/snip/api/runner"
 )
 
 var testH *handler
@@ -16,15 +22,21 @@ var (
 )
 
 func TestMain(m *testing.M) {
-	if testing.Short() {
-		return
+	// the local executor starts the test binary again to run the runner
+	if IsLocalRunner() {
+		RunLocalRunner()
+		os.Exit(0)
 	}
 
-	var err error
-	testH, err = newTestHandler()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	flag.Parse()
+
+	if !testing.Short() {
+		var err error
+		testH, err = newTestHandler()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	}
 
 	os.Exit(m.Run())
@@ -39,8 +51,64 @@ func newTestHandler() (h *handler, err error) {
 		return nil, err
 	}
 
-	if h.dockerClient, err = client.NewEnvClient(); err != nil {
+	if h.executor, err = newDockerExecutor(h.config, nil); err != nil {
 		return nil, err
 	}
 	return h, nil
 }
+
+// newFakeHandler returns a handler which does not need docker or mongo.
+func newFakeHandler() *handler {
+	return &handler{
+		config: defaultConfig(),
+		languages: []*Language{
+			{ID: "ash", Name: "Ash", Extension: "sh", Run: "sh $FILE"},
+			{ID: "plaintext", Name: "Plain Text", Extension: "txt", NotRunnable: true},
+		},
+		executor: fakeExecutor{},
+	}
+}
+
+// fakeExecutor does not run anything, it echoes the stdin of every case to
+// stdout and exits with 0. Interactive stdin is echoed line by line.
+type fakeExecutor struct{}
+
+func (fakeExecutor) Execute(ctx context.Context, payload *runner.Payload, language *Language, resources Resources, stdin io.Reader, events chan<- *runner.Event) (*runner.Result, error) {
+	defer close(events)
+	zero := 0
+	res := &runner.Result{ExitCode: &zero}
+	if len(payload.Cases) == 0 {
+		if payload.Stdin != "" {
+			events <- &runner.Event{Type: runner.Stdout, Phase: runner.RunPhase, Message: payload.Stdin}
+		}
+		if stdin != nil {
+			s := bufio.NewScanner(stdin)
+			for s.Scan() {
+				events <- &runner.Event{Type: runner.Stdout, Phase: runner.RunPhase, Message: s.Text() + "\n"}
+			}
+		}
+		res.Run = &runner.PhaseResult{ExitCode: &zero}
+		return res, nil
+	}
+	for i, c := range payload.Cases {
+		i := i
+		if c.Stdin != "" {
+			events <- &runner.Event{Type: runner.Stdout, Phase: runner.RunPhase, Case: &i, Message: c.Stdin}
+		}
+		res.Cases = append(res.Cases, &runner.PhaseResult{ExitCode: &zero})
+	}
+	return res, nil
+}
+
+func doTestRequest(h *handler, method, url, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.getAPIHandler().ServeHTTP(w, r)
+	return w
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	if w.Code != status {
+		t.Fatalf("expected status %d %s, actual %d: %s", status, http.StatusText(status), w.Code, w.Body.String())
+	}
+}
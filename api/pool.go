@@ -0,0 +1,205 @@
+package api
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	poolHits   = expvar.NewMap("poolHits")
+	poolMisses = expvar.NewMap("poolMisses")
+)
+
+// containerPool keeps up to size started containers per language for which
+// pooled returns true, other languages are never started ahead of time. Every
+// container is handed out once and replaced afterwards, containers which are
+// idle for longer than ttl are removed and replaced as well. Containers
+// whose removal failed are retried when the pool expires or is closed.
+type containerPool struct {
+	size   int
+	ttl    time.Duration
+	pooled func(id string) bool
+	start  func(context.Context, *Language) (*startedContainer, error)
+	remove func(id string) error
+	done   chan bool
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	idle     map[string][]*startedContainer
+	starting map[string]int
+	orphans  []string
+	closed   bool
+}
+
+func newContainerPool(size int, ttl time.Duration, pooled func(string) bool, start func(context.Context, *Language) (*startedContainer, error), remove func(string) error) *containerPool {
+	p := &containerPool{
+		size:     size,
+		ttl:      ttl,
+		pooled:   pooled,
+		start:    start,
+		remove:   remove,
+		done:     make(chan bool),
+		idle:     map[string][]*startedContainer{},
+		starting: map[string]int{},
+	}
+	if ttl > 0 {
+		go p.expireLoop()
+	}
+	return p
+}
+
+// get returns an idle container of the language or nil if there is none.
+// The pool is refilled in the background in both cases.
+func (p *containerPool) get(language *Language) *startedContainer {
+	if p == nil || !p.pooled(language.ID) {
+		return nil
+	}
+
+	p.mu.Lock()
+	var c *startedContainer
+	if cs := p.idle[language.ID]; len(cs) > 0 {
+		c = cs[0]
+		p.idle[language.ID] = cs[1:]
+	}
+	p.mu.Unlock()
+
+	if c != nil {
+		poolHits.Add(language.ID, 1)
+	} else {
+		poolMisses.Add(language.ID, 1)
+	}
+	p.fill(language)
+	return c
+}
+
+func (p *containerPool) fill(language *Language) {
+	p.mu.Lock()
+	n := p.size - len(p.idle[language.ID]) - p.starting[language.ID]
+	if p.closed || !p.pooled(language.ID) {
+		n = 0
+	}
+	if n > 0 {
+		p.starting[language.ID] += n
+		p.wg.Add(n)
+	}
+	p.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		go func() {
+			defer p.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			c, err := p.start(ctx, language)
+
+			p.mu.Lock()
+			p.starting[language.ID]--
+			closed := p.closed
+			if err == nil && !closed {
+				p.idle[language.ID] = append(p.idle[language.ID], c)
+			}
+			p.mu.Unlock()
+
+			if err != nil {
+				log.WithField("language", language.ID).Warn("starting pool container failed: " + err.Error())
+			} else if closed {
+				p.removeContainer(c)
+			}
+		}()
+	}
+}
+
+func (p *containerPool) expireLoop() {
+	t := time.NewTicker(p.ttl / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.expire()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// removeContainer removes c or remembers it for the next try.
+func (p *containerPool) removeContainer(c *startedContainer) {
+	if c.conn.Conn != nil {
+		c.conn.Close()
+	}
+	p.removeID(c.id)
+}
+
+func (p *containerPool) removeID(id string) {
+	if err := p.remove(id); err != nil {
+		log.WithField("id", id).Warn("removing pool container failed: " + err.Error())
+		p.mu.Lock()
+		p.orphans = append(p.orphans, id)
+		p.mu.Unlock()
+	}
+}
+
+// removeOrphans retries the removal of the containers whose removal failed.
+func (p *containerPool) removeOrphans() {
+	p.mu.Lock()
+	orphans := p.orphans
+	p.orphans = nil
+	p.mu.Unlock()
+	for _, id := range orphans {
+		p.removeID(id)
+	}
+}
+
+// close removes all containers of the pool, including the ones which are
+// still starting, and stops refilling it.
+func (p *containerPool) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	var cs []*startedContainer
+	for id, idle := range p.idle {
+		cs = append(cs, idle...)
+		delete(p.idle, id)
+	}
+	p.mu.Unlock()
+	close(p.done)
+
+	for _, c := range cs {
+		p.removeContainer(c)
+	}
+	p.wg.Wait()
+	p.removeOrphans()
+}
+
+func (p *containerPool) expire() {
+	p.removeOrphans()
+
+	var expired []*startedContainer
+	p.mu.Lock()
+	for id, cs := range p.idle {
+		var keep []*startedContainer
+		for _, c := range cs {
+			if time.Since(c.started) > p.ttl {
+				expired = append(expired, c)
+			} else {
+				keep = append(keep, c)
+			}
+		}
+		p.idle[id] = keep
+	}
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		p.removeContainer(c)
+		p.fill(c.language)
+	}
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeContainers struct {
+	mu       sync.Mutex
+	started  int
+	removed  []string
+	failures int
+}
+
+func (f *fakeContainers) start(ctx context.Context, l *Language) (*startedContainer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started++
+	return &startedContainer{id: strconv.Itoa(f.started), language: l, started: time.Now()}, nil
+}
+
+func (f *fakeContainers) remove(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("removal failed")
+	}
+	f.removed = append(f.removed, id)
+	return nil
+}
+
+func (f *fakeContainers) count() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.started, len(f.removed)
+}
+
+func waitForIdle(t *testing.T, p *containerPool, l *Language, n int) {
+	for i := 0; i < 100; i++ {
+		p.mu.Lock()
+		idle := len(p.idle[l.ID])
+		p.mu.Unlock()
+		if idle == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d idle containers", n)
+}
+
+func poolAll(id string) bool {
+	return true
+}
+
+func TestContainerPool(t *testing.T) {
+	f := &fakeContainers{}
+	p := newContainerPool(2, 0, poolAll, f.start, f.remove)
+	l := &Language{ID: "ash"}
+
+	if c := p.get(l); c != nil {
+		t.Fatal("expected a miss on an empty pool")
+	}
+	waitForIdle(t, p, l, 2)
+
+	c1, c2 := p.get(l), p.get(l)
+	if c1 == nil || c2 == nil || c1.id == c2.id {
+		t.Fatal("expected two different containers")
+	}
+	waitForIdle(t, p, l, 2)
+	if started, _ := f.count(); started != 4 {
+		t.Errorf("expected 4 started containers, actual %d", started)
+	}
+
+	p.ttl = time.Nanosecond
+	p.expire()
+	waitForIdle(t, p, l, 2)
+	if started, removed := f.count(); started != 6 || removed != 2 {
+		t.Errorf("expected 6 started and 2 removed containers, actual %d and %d", started, removed)
+	}
+}
+
+func TestContainerPoolClose(t *testing.T) {
+	f := &fakeContainers{}
+	p := newContainerPool(2, time.Hour, poolAll, f.start, f.remove)
+	l := &Language{ID: "ash"}
+	p.fill(l)
+	waitForIdle(t, p, l, 2)
+
+	// the first removal fails and is retried
+	f.failures = 1
+	p.close()
+	p.fill(l)
+	if started, removed := f.count(); started != 2 || removed != 2 {
+		t.Errorf("expected 2 started and 2 removed containers, actual %d and %d", started, removed)
+	}
+	if p.get(l) != nil {
+		t.Error("expected no containers after close")
+	}
+}
+
+func TestContainerPoolLanguages(t *testing.T) {
+	f := &fakeContainers{}
+	p := newContainerPool(2, 0, (&Config{PoolLanguages: "ash"}).isPoolLanguage, f.start, f.remove)
+	defer p.close()
+	ash, other := &Language{ID: "ash"}, &Language{ID: "other"}
+
+	if p.get(other) != nil || p.get(ash) != nil {
+		t.Fatal("expected a miss on an empty pool")
+	}
+	waitForIdle(t, p, ash, 2)
+	p.fill(other)
+	if started, _ := f.count(); started != 2 {
+		t.Errorf("expected only the pool language to be started, actual %d containers", started)
+	}
+}
@@ -1,31 +1,27 @@
 package api
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/binary"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io"
+	"expvar"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	dockerTypes "github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
 	"github.com/gorilla/mux"
 	"github.com/rojul/snip/api/runner"
 )
 
 var (
-	errOutputTruncated = errors.New("output truncated")
+	abortedRuns   = expvar.NewInt("abortedRuns")
+	skippedRuns   = expvar.NewInt("skippedRuns")
+	queueTimeouts = expvar.NewInt("queueTimeouts")
 )
 
 func (h *handler) runRouter(r *mux.Router) {
 	r.HandleFunc("", h.runHandler).Methods("POST")
+	r.HandleFunc("/ws", h.runWSHandler).Methods("GET")
+	r.HandleFunc("/batch", h.runBatchHandler).Methods("POST")
 }
 
 func (h *handler) runHandler(w http.ResponseWriter, r *http.Request) {
@@ -34,162 +30,209 @@ func (h *handler) runHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	language, err := h.getLanguage(payload.Language)
+	language, t, err := h.prepareRun(r, &payload)
 	if err != nil {
-		sendError(w, err)
+		h.sendRunError(w, err)
 		return
 	}
 
-	if err := payload.getValidationError(); err != nil {
-		sendError(w, HTTPError{Status: http.StatusBadRequest, Msg: "Invalid payload: " + err.Error()})
-		return
-	}
+	h.streamRun(w, r, &payload, language, t)
+}
 
-	h.runContainerHTTPResponse(&payload, language, w)
+// streamRun responds with server-sent events if the client accepts them and
+// with NDJSON otherwise.
+func (h *handler) streamRun(w http.ResponseWriter, r *http.Request, payload *Payload, language *Language, t *ticket) {
+	payload.noCache = noCacheRequested(r)
+	h.runContainerStream(r.Context(), payload, language, t, newStreamWriter(w, r, 0))
 }
 
-func (h *handler) removeContainer(id string) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// prepareRun validates the payload of the request and requests a ticket for it.
+func (h *handler) prepareRun(r *http.Request, payload *Payload) (*Language, *ticket, error) {
+	language, err := h.getLanguage(payload.Language)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if err := h.dockerClient.ContainerRemove(ctx, id, dockerTypes.ContainerRemoveOptions{Force: true}); err != nil {
-		if strings.Contains(err.Error(), "is already in progress") ||
-			strings.Contains(err.Error(), "No such container") {
-			return
+	payload.normalize()
+	if err := payload.getValidationError(); err != nil {
+		return nil, nil, HTTPError{Status: http.StatusBadRequest, Msg: "Invalid payload: " + err.Error()}
+	}
+	if payload.Network && !h.config.NetworkEnabled {
+		if !language.Network {
+			return nil, nil, HTTPError{Status: http.StatusBadRequest, Msg: "Network access is not allowed for this language"}
+		}
+		if h.config.Network == "" {
+			return nil, nil, HTTPError{Status: http.StatusBadRequest, Msg: "Network access is not available"}
 		}
-		log.Debug("killing container failed: " + err.Error())
 	}
+
+	payload.raiseLimits = h.canRaiseLimits(r)
+
+	t, err := h.scheduler.enqueue(language.ID)
+	if err == errQueueFull {
+		return nil, nil, HTTPErrorTooManyRuns
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return language, t, nil
 }
 
-func (h *handler) runContainer(payload *Payload, language *Language, events chan<- *runner.Event) (*runner.Result, error) {
-	defer close(events)
-	if language.NotRunnable {
-		return &runner.Result{Error: "This language is not runnable"}, nil
+func (h *handler) sendRunError(w http.ResponseWriter, err error) {
+	if err == HTTPErrorTooManyRuns {
+		w.Header().Set("Retry-After", strconv.Itoa(int(h.config.RunTimeout/time.Second)))
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), h.config.RunTimeout)
-	defer cancel()
+	sendError(w, err)
+}
 
-	if payload.Command == "" {
-		payload.Command = language.Command
+// runContainer runs the payload as soon as the scheduler allows it. If t is
+// nil a new ticket is requested, otherwise t is used and released.
+func (h *handler) runContainer(ctx context.Context, payload *Payload, language *Language, t *ticket, events chan<- *runner.Event) (*runner.Result, error) {
+	if language.NotRunnable {
+		if t != nil {
+			t.release()
+		}
+		close(events)
+		return &runner.Result{Error: "This language is not runnable"}, nil
 	}
 
-	image := language.Image
-	if image == "" {
-		image = h.config.DefaultImagePrefix + "/" + language.ID
+	if t == nil {
+		var err error
+		if t, err = h.scheduler.enqueue(language.ID); err != nil {
+			close(events)
+			return nil, err
+		}
 	}
+	defer t.release()
 
-	containerConfig := &container.Config{
-		Image:           image,
-		AttachStdin:     true,
-		AttachStdout:    true,
-		AttachStderr:    true,
-		OpenStdin:       true,
-		StdinOnce:       true,
-		NetworkDisabled: !h.config.NetworkEnabled,
-		User:            "1000:1000",
+	if payload.Command == "" {
+		if payload.Compile == "" {
+			payload.Compile = language.Compile
+		}
+		payload.Command = language.Run
 	}
-	hostConfig := &container.HostConfig{
-		AutoRemove: true,
-		CapDrop:    []string{"ALL"},
-		Resources: container.Resources{
-			Memory:     h.config.Memory,
-			MemorySwap: h.config.Memory,
-			NanoCPUs:   h.config.NanoCPUs,
-			CPUShares:  h.config.CPUShares,
-			PidsLimit:  h.config.PidsLimit,
-		},
-		LogConfig: container.LogConfig{
-			Type: "none",
-		},
-		Tmpfs: map[string]string{
-			"/tmp":       "exec",
-			"/home/snip": "exec,uid=1000,gid=1000",
-		},
-		ReadonlyRootfs: true,
+	payload.ArtifactSizeLimit = h.config.ArtifactSizeLimit
+	payload.StdoutLimit = h.config.StdoutLimit
+	payload.StderrLimit = h.config.StderrLimit
+	payload.Interactive = payload.stdin != nil
+	resources := h.runResources(payload, language)
+	if payload.Network && resources.Network == networkNone {
+		resources.Network = networkAllowlist
 	}
 
-	c, err := h.dockerClient.ContainerCreate(ctx, containerConfig, hostConfig, nil, "")
-	if err != nil {
-		return nil, err
+	key := h.cacheKey(ctx, payload, language, resources)
+	if r, es, ok := h.cache.get(key); ok {
+		for _, e := range es {
+			events <- e
+		}
+		close(events)
+		return r, nil
 	}
-	log.WithFields(log.Fields{
-		"id":       c.ID[:12],
-		"language": language.ID,
-	}).Debug("container started")
-
-	go func() {
-		<-ctx.Done()
-		h.removeContainer(c.ID)
-	}()
 
-	attachOptions := dockerTypes.ContainerAttachOptions{
-		Stream: true,
-		Stdin:  true,
-		Stdout: true,
-		Stderr: true,
+	// the wait is bounded, so the run finishes within the write timeout
+	waitCtx, cancel := context.WithTimeout(ctx, h.config.QueueTimeout)
+	waitErr := t.wait(waitCtx, events)
+	cancel()
+	if waitErr != nil {
+		close(events)
+		if ctx.Err() == nil {
+			queueTimeouts.Add(1)
+			return &runner.Result{Error: "Timed out waiting for a free slot"}, nil
+		}
+		return canceledRun(payload, language, "queued"), nil
 	}
 
-	res, err := h.dockerClient.ContainerAttach(ctx, c.ID, attachOptions)
-	if err != nil {
-		return nil, err
+	var recorded func() []*runner.Event
+	if key != "" {
+		events, recorded = recordEvents(events)
 	}
-	defer res.Close()
-
-	err = h.dockerClient.ContainerStart(ctx, c.ID, dockerTypes.ContainerStartOptions{})
-	if err != nil {
-		return nil, err
+	var r *runner.Result
+	var err error
+	if payload.Expected == nil {
+		r, err = h.executor.Execute(ctx, &payload.Payload, language, resources, payload.stdin, events)
+	} else {
+		r, err = h.executeJudged(ctx, payload, language, resources, events)
 	}
-
-	payloadBytes, err := json.Marshal(payload.Payload)
-	if err != nil {
-		return nil, err
+	if ctx.Err() == context.Canceled {
+		return canceledRun(payload, language, "running"), nil
 	}
-	res.Conn.Write(payloadBytes)
-	res.CloseWrite()
-
-	result := &runner.Result{}
+	if err == nil {
+		r.Limits = resources.runnerLimits()
+	}
+	if recorded != nil {
+		es := recorded()
+		if err == nil && isCacheable(r) {
+			h.cache.put(key, r, es)
+		}
+	}
+	return r, err
+}
 
+// recordEvents returns a channel whose events are forwarded to out and a
+// function which returns all events once the channel is closed.
+func recordEvents(out chan<- *runner.Event) (chan<- *runner.Event, func() []*runner.Event) {
+	in := make(chan *runner.Event)
 	done := make(chan bool)
-	lines := make(chan []byte)
+	var es []*runner.Event
 	go func() {
-		for l := range lines {
-			var e runner.Event
-			if err := json.Unmarshal(l, &e); err == nil && e.Type != "" {
-				events <- &e
-			} else if err := json.Unmarshal(l, result); err == nil && !result.IsEmpty() {
-			} else {
-				result = &runner.Result{Error: "Invalid response: " + string(l)}
-				break
-			}
+		for e := range in {
+			es = append(es, e)
+			out <- e
 		}
+		close(out)
 		done <- true
 	}()
-
-	stderr, err := collectDockerStream(res.Reader, h.config.ReturnSizeLimit, lines)
-	<-done
-	if stderr != "" {
-		if err == errOutputTruncated {
-			stderr += "\n[truncated]"
-		}
-		return &runner.Result{Error: "Container returned an error:\n\n" + stderr}, nil
+	return in, func() []*runner.Event {
+		<-done
+		return es
 	}
-	if err == errOutputTruncated {
-		return &runner.Result{Error: "Output truncated"}, nil
+}
+
+// canceledRun returns the result of a run whose context was canceled, either
+// by the batch it belongs to or by the client.
+func canceledRun(payload *Payload, language *Language, state string) *runner.Result {
+	select {
+	case <-payload.skipped:
+		return skipRun(language, state)
+	default:
+		return abortRun(language, state)
 	}
+}
+
+// skipRun records a run which was canceled after another run of its batch
+// failed, and returns its result.
+func skipRun(language *Language, state string) *runner.Result {
+	skippedRuns.Add(1)
+	log.WithFields(log.Fields{
+		"language": language.ID,
+		"state":    state,
+	}).Info("run skipped after failure")
+	return &runner.Result{Error: "Skipped after failure"}
+}
+
+// abortRun records a canceled run, e.g. when the client closed the
+// connection, and returns its result.
+func abortRun(language *Language, state string) *runner.Result {
+	abortedRuns.Add(1)
+	log.WithFields(log.Fields{
+		"language": language.ID,
+		"state":    state,
+	}).Info("run aborted")
+	return &runner.Result{Error: "Run canceled"}
+}
+
+func (h *handler) executeJudged(ctx context.Context, payload *Payload, language *Language, resources Resources, events chan<- *runner.Event) (*runner.Result, error) {
+	tee, recorded := recordEvents(events)
+	r, err := h.executor.Execute(ctx, &payload.Payload, language, resources, payload.stdin, tee)
+	es := recorded()
 	if err != nil {
 		return nil, err
 	}
-	if ctx.Err() == context.DeadlineExceeded {
-		return &runner.Result{Error: "Container timed out"}, nil
-	}
-	if result.IsEmpty() {
-		result = &runner.Result{Error: "No response from container"}
-	}
-
-	return result, nil
+	r.Verdict = payload.Expected.judge(r, es)
+	return r, nil
 }
 
-func (h *handler) runContainerSync(payload *Payload, language *Language) (*runner.Result, error) {
+func (h *handler) runContainerSync(ctx context.Context, payload *Payload, language *Language) (*runner.Result, error) {
 	events := make(chan *runner.Event)
 	done := make(chan bool)
 	var es []*runner.Event
@@ -199,86 +242,42 @@ func (h *handler) runContainerSync(payload *Payload, language *Language) (*runne
 		}
 		done <- true
 	}()
-	r, err := h.runContainer(payload, language, events)
+	r, err := h.runContainer(ctx, payload, language, nil, events)
 	<-done
-	r.Events = es
-	return r, err
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range es {
+		r.Append(e)
+	}
+	return r, nil
 }
 
-func (h *handler) runContainerHTTPResponse(payload *Payload, language *Language, w http.ResponseWriter) {
-	w.Header().Set("Content-Type", "application/x-ndjson; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+// runContainerStream sends the events and the result of the run to s.
+func (h *handler) runContainerStream(ctx context.Context, payload *Payload, language *Language, t *ticket, s streamWriter) {
 	events := make(chan *runner.Event)
 	done := make(chan bool)
-	f, fOk := w.(http.Flusher)
-	if !fOk {
-		log.Debug("streaming unsupported")
-	}
 	go func() {
-		for e := range events {
-			json.NewEncoder(w).Encode(e)
-			if fOk {
-				f.Flush()
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					done <- true
+					return
+				}
+				s.send(string(e.Type), e)
+			case <-heartbeat.C:
+				s.keepAlive()
 			}
 		}
-		done <- true
 	}()
-	r, err := h.runContainer(payload, language, events)
+	r, err := h.runContainer(ctx, payload, language, t, events)
 	<-done
 	if err != nil {
 		log.Error(err.Error())
 		r = &runner.Result{Error: http.StatusText(http.StatusInternalServerError)}
 	}
-	json.NewEncoder(w).Encode(r)
-}
-
-func collectDockerStream(stream io.Reader, limit int64, lines chan<- []byte) (string, error) {
-	defer close(lines)
-	var n int64
-	var stderr bytes.Buffer
-	var buf bytes.Buffer
-	header := make([]byte, 8)
-	for {
-		n += 8
-		if n > limit {
-			return stderr.String(), errOutputTruncated
-		}
-		if _, err := io.ReadFull(stream, header); err != nil {
-			if err == io.EOF {
-				return stderr.String(), nil
-			}
-			return "", err
-		}
-
-		var w io.Writer
-		if header[0] == 1 {
-			w = bufio.NewWriter(&buf)
-		} else if header[0] == 2 {
-			w = bufio.NewWriter(&stderr)
-		} else {
-			return "", fmt.Errorf("invalid STREAM_TYPE: %x", header[0])
-		}
-
-		frameSize := int64(binary.BigEndian.Uint32(header[4:]))
-		n += frameSize
-		if n > limit {
-			frameSize -= n - limit
-		}
-
-		if _, err := io.CopyN(w, stream, frameSize); err != nil {
-			return "", err
-		}
-
-		s := bufio.NewScanner(bufio.NewReader(&buf))
-		for s.Scan() {
-			lines <- s.Bytes()
-		}
-		if err := s.Err(); err != nil {
-			return "", err
-		}
-
-		if n > limit {
-			return stderr.String(), errOutputTruncated
-		}
-	}
+	s.send(sseResult, r)
 }
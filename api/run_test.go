@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/rojul/snip/api/runner"
+)
+
+func decodeRunResponse(t *testing.T, body string) ([]*runner.Event, *runner.Result) {
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	var events []*runner.Event
+	for _, l := range lines[:len(lines)-1] {
+		var e runner.Event
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, &e)
+	}
+	var r runner.Result
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &r); err != nil {
+		t.Fatal(err)
+	}
+	return events, &r
+}
+
+func TestRunHandler(t *testing.T) {
+	h := newFakeHandler()
+	w := doTestRequest(h, "POST", "/run", `{"language":"ash","files":[{"name":"main.sh","content":"cat"}],"stdin":"Hello World\n"}`)
+	expectStatus(t, w, http.StatusOK)
+
+	events, r := decodeRunResponse(t, w.Body.String())
+	r.Events = events
+	if !compareResult(r, "Hello World\n", "") {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+}
+
+func TestRunHandlerExpected(t *testing.T) {
+	h := newFakeHandler()
+	w := doTestRequest(h, "POST", "/run", `{
+		"language": "ash",
+		"files": [{"name": "main.sh", "content": "cat"}],
+		"cases": [{"stdin": "1\n"}, {"stdin": "2\n"}],
+		"expected": {"cases": [{"stdout": "1\n"}, {"stdout": "3\n"}]}
+	}`)
+	expectStatus(t, w, http.StatusOK)
+
+	_, r := decodeRunResponse(t, w.Body.String())
+	if r.Verdict == nil || r.Verdict.Status != runner.WrongAnswer || len(r.Verdict.Cases) != 2 ||
+		r.Verdict.Cases[0].Status != runner.Accepted {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+}
+
+func TestRunHandlerLimits(t *testing.T) {
+	h := newFakeHandler()
+	h.config.LimitsToken = "secret"
+	h.config.MaxRunTimeout = time.Minute
+	body := `{
+		"language": "ash",
+		"files": [{"name": "main.sh", "content": "cat"}],
+		"limits": {"timeout": "1h", "memory": "32m", "cpus": 0.5}
+	}`
+	expected := runner.Limits{
+		Timeout: int64(h.config.RunTimeout / time.Millisecond),
+		Memory:  32 * units.MiB,
+		CPUs:    0.5,
+		Pids:    h.config.PidsLimit,
+		Network: networkNone,
+	}
+
+	// without the token limits can only be lowered
+	for _, auth := range []string{"", "Bearer wrong", "Bearer secret"} {
+		r := httptest.NewRequest("POST", "/run", strings.NewReader(body))
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.getAPIHandler().ServeHTTP(w, r)
+		expectStatus(t, w, http.StatusOK)
+
+		if auth == "Bearer secret" {
+			expected.Timeout = int64(h.config.MaxRunTimeout / time.Millisecond)
+		}
+		_, res := decodeRunResponse(t, w.Body.String())
+		if res.Limits == nil || *res.Limits != expected {
+			t.Errorf("%q: unexpected response: %s", auth, w.Body.String())
+		}
+	}
+}
+
+func TestRunHandlerNetwork(t *testing.T) {
+	h := newFakeHandler()
+	body := `{"language":"ash","files":[{"name":"main.sh","content":"cat"}],"network":true}`
+	w := doTestRequest(h, "POST", "/run", body)
+	expectStatus(t, w, http.StatusBadRequest)
+
+	l, _ := h.getLanguage("ash")
+	l.Network = true
+	w = doTestRequest(h, "POST", "/run", body)
+	expectStatus(t, w, http.StatusBadRequest)
+
+	h.config.Network = "snip-runs"
+	w = doTestRequest(h, "POST", "/run", body)
+	expectStatus(t, w, http.StatusOK)
+	if _, r := decodeRunResponse(t, w.Body.String()); r.Limits == nil || r.Limits.Network != networkAllowlist {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+}
+
+func TestRunHandlerErrors(t *testing.T) {
+	var errorTests = []struct {
+		body   string
+		status int
+	}{
+		{`{`, http.StatusBadRequest},
+		{`{"language":"unknown","files":[{"name":"main","content":""}]}`, http.StatusNotFound},
+		{`{"language":"ash","files":[]}`, http.StatusBadRequest},
+		{`{"language":"ash","files":[{"name":"../main.sh","content":""}]}`, http.StatusBadRequest},
+		{`{"language":"ash","files":[{"name":"main.sh","content":""}],"env":{"LD_PRELOAD":"x"}}`, http.StatusBadRequest},
+		{`{"language":"ash","files":[null]}`, http.StatusBadRequest},
+		{`{"language":"ash","files":[{"name":"main.sh","content":""}],"cases":[null]}`, http.StatusBadRequest},
+		{`{"language":"ash","files":[{"name":"main.sh","content":""}],"expected":{"cases":[null]}}`, http.StatusBadRequest},
+		{`{"language":"ash","files":[{"name":"main.sh","content":""}],"limits":{"memory":-1}}`, http.StatusBadRequest},
+		{`{"language":"ash","files":[{"name":"main.sh","content":""}],"limits":{"cpus":1e300}}`, http.StatusBadRequest},
+		{`{"language":"ash","files":[{"name":"main.sh","content":""}],"limits":{"memory":"1e30g"}}`, http.StatusBadRequest},
+		{`{"language":"ash","files":[{"name":"main.sh","content":""}],"limits":{"memory":"1k"}}`, http.StatusBadRequest},
+		{`{"language":"ash","files":[{"name":"main.sh","content":""}],"limits":{"cpus":0.001}}`, http.StatusBadRequest},
+		{`{"language":"ash","files":[{"name":"main.sh","content":""}],"limits":{"timeout":"1ms"}}`, http.StatusBadRequest},
+	}
+
+	h := newFakeHandler()
+	for _, tt := range errorTests {
+		w := doTestRequest(h, "POST", "/run", tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, actual %d", tt.body, tt.status, w.Code)
+		}
+	}
+
+	w := doTestRequest(h, "POST", "/run", `{"language":"plaintext","files":[{"name":"main.txt","content":""}]}`)
+	expectStatus(t, w, http.StatusOK)
+	if _, r := decodeRunResponse(t, w.Body.String()); r.Error == "" {
+		t.Errorf("expected error for not runnable language: %s", w.Body.String())
+	}
+}
+
+// blockingExecutor runs until the context is done.
+type blockingExecutor struct {
+	started chan bool
+}
+
+func (e blockingExecutor) Execute(ctx context.Context, payload *runner.Payload, language *Language, resources Resources, stdin io.Reader, events chan<- *runner.Event) (*runner.Result, error) {
+	defer close(events)
+	e.started <- true
+	<-ctx.Done()
+	return &runner.Result{Error: "No response from container"}, nil
+}
+
+func TestRunContainerCanceled(t *testing.T) {
+	h := newFakeHandler()
+	e := blockingExecutor{make(chan bool)}
+	h.executor = e
+	l, _ := h.getLanguage("ash")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-e.started
+		cancel()
+	}()
+	r, err := h.runContainerSync(ctx, &Payload{}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Error != "Run canceled" {
+		t.Errorf("expected canceled run, actual %s", mustToJSON(r))
+	}
+}
@@ -0,0 +1,69 @@
+package runner
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const maxArtifacts = 20
+
+type Artifact struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Content  string `json:"content,omitempty"`
+	TooLarge bool   `json:"tooLarge,omitempty"`
+}
+
+// collectArtifacts returns the regular files matching the patterns in
+// lexical order. Files are base64 encoded as long as they fit into limit,
+// larger ones are only listed.
+func collectArtifacts(patterns []string, limit int64) ([]*Artifact, error) {
+	seen := map[string]bool{}
+	var names []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			m = filepath.Clean(m)
+			if seen[m] {
+				continue
+			}
+			seen[m] = true
+			if fi, err := os.Stat(m); err == nil && fi.Mode().IsRegular() {
+				names = append(names, m)
+			}
+		}
+	}
+	sort.Strings(names)
+	if len(names) > maxArtifacts {
+		names = names[:maxArtifacts]
+	}
+
+	var artifacts []*Artifact
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		a := &Artifact{Name: filepath.ToSlash(name), Size: fi.Size()}
+		artifacts = append(artifacts, a)
+
+		encodedSize := int64(base64.StdEncoding.EncodedLen(int(fi.Size())))
+		if encodedSize > limit {
+			a.TooLarge = true
+			continue
+		}
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		a.Content = base64.StdEncoding.EncodeToString(b)
+		limit -= int64(len(a.Content))
+	}
+	return artifacts, nil
+}
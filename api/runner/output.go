@@ -0,0 +1,111 @@
+package runner
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"unicode/utf8"
+)
+
+// streamLimit is shared by all phases of a run. The limit applies to the
+// size of the encoded events, written counts the bytes of the stream.
+type streamLimit struct {
+	limit     int64
+	used      int64
+	written   int64
+	truncated bool
+}
+
+// output writes the events of all phases to w. Once a stream exceeds its
+// limit, its output is cut and further writes to it are only counted.
+type output struct {
+	w              io.Writer
+	mu             sync.Mutex
+	stdout, stderr streamLimit
+}
+
+// newOutput returns an output with the limits in bytes, zero means unlimited.
+func newOutput(w io.Writer, stdoutLimit, stderrLimit int64) *output {
+	return &output{
+		w:      w,
+		stdout: streamLimit{limit: stdoutLimit},
+		stderr: streamLimit{limit: stderrLimit},
+	}
+}
+
+type eventWriter struct {
+	o     *output
+	s     *streamLimit
+	event Event
+}
+
+// writers returns writers for stdout and stderr which emit copies of tag
+// with the type and message filled in.
+func (o *output) writers(tag Event) (stdout, stderr *eventWriter) {
+	stdout = &eventWriter{o, &o.stdout, tag}
+	stdout.event.Type = Stdout
+	stderr = &eventWriter{o, &o.stderr, tag}
+	stderr.event.Type = Stderr
+	return stdout, stderr
+}
+
+func (ew *eventWriter) Write(b []byte) (n int, err error) {
+	ew.o.mu.Lock()
+	defer ew.o.mu.Unlock()
+
+	s := ew.s
+	s.written += int64(len(b))
+	if s.truncated {
+		return len(b), nil
+	}
+
+	e := ew.event
+	e.Message = string(b)
+	line, _ := json.Marshal(&e)
+	if s.limit > 0 && s.used+int64(len(line))+1 > s.limit {
+		s.truncated = true
+		if line = truncateEvent(e, b, s.limit-s.used-1); line == nil {
+			return len(b), nil
+		}
+	}
+	s.used += int64(len(line)) + 1
+	ew.o.w.Write(append(line, '\n'))
+
+	return len(b), nil
+}
+
+// truncateEvent returns e with the longest prefix of b as message whose
+// encoding fits into limit, or nil if not even an empty message fits.
+func truncateEvent(e Event, b []byte, limit int64) []byte {
+	e.Message = ""
+	empty, _ := json.Marshal(&e)
+	n := limit - int64(len(empty))
+	if n > int64(len(b)) {
+		n = int64(len(b))
+	}
+	// escaping can make the message longer than its bytes, so the prefix is
+	// shortened until it fits
+	for ; n > 0; n /= 2 {
+		prefix := b[:n]
+		for i := 0; i < utf8.UTFMax-1 && len(prefix) > 0 && !utf8.Valid(prefix); i++ {
+			prefix = prefix[:len(prefix)-1]
+		}
+		if len(prefix) == 0 {
+			return nil
+		}
+		e.Message = string(prefix)
+		line, _ := json.Marshal(&e)
+		if int64(len(line)) <= limit {
+			return line
+		}
+	}
+	return nil
+}
+
+// setStats stores the sizes of the streams in res.
+func (o *output) setStats(res *Result) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	res.Output = &Output{Stdout: o.stdout.written, Stderr: o.stderr.written}
+	res.Truncated = o.stdout.truncated || o.stderr.truncated
+}
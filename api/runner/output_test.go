@@ -0,0 +1,76 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestOutputLimits(t *testing.T) {
+	var buf bytes.Buffer
+	o := newOutput(&buf, 100, 0)
+	stdout, stderr := o.writers(Event{Phase: RunPhase})
+	for i := 0; i < 10; i++ {
+		stdout.Write([]byte("line\n"))
+	}
+	stdout.Write([]byte(strings.Repeat("ä", 100)))
+	stderr.Write([]byte(strings.Repeat("e", 200)))
+
+	if buf.Len() > 100+len(`{"type":"stderr","phase":"run","message":""}`)+1+200 {
+		t.Errorf("output exceeds limits: %s", buf.String())
+	}
+
+	msgs := map[EventType]string{}
+	for _, e := range decodeEvents(t, buf.Bytes()) {
+		msgs[e.Type] += e.Message
+	}
+	if !strings.HasPrefix(msgs[Stdout], "line\n") || !strings.HasPrefix(strings.Repeat("line\n", 10), msgs[Stdout]) {
+		t.Errorf("unexpected stdout: %q", msgs[Stdout])
+	}
+	if msgs[Stderr] != strings.Repeat("e", 200) {
+		t.Errorf("unexpected stderr: %q", msgs[Stderr])
+	}
+
+	var res Result
+	o.setStats(&res)
+	if !res.Truncated || res.Output == nil || res.Output.Stdout != 250 || res.Output.Stderr != 200 {
+		t.Errorf("unexpected result: %+v %+v", res, res.Output)
+	}
+}
+
+func TestTruncateEvent(t *testing.T) {
+	e := Event{Type: Stdout, Phase: RunPhase}
+	b := []byte(strings.Repeat("ä", 10) + "\n\n\n")
+	for limit := int64(0); limit < 80; limit++ {
+		line := truncateEvent(e, b, limit)
+		if line == nil {
+			continue
+		}
+		if int64(len(line)) > limit {
+			t.Errorf("limit %d: event too long: %s", limit, line)
+		}
+		var d Event
+		if err := json.Unmarshal(line, &d); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(b), d.Message) || strings.ContainsRune(d.Message, '�') {
+			t.Errorf("limit %d: invalid prefix %q", limit, d.Message)
+		}
+	}
+}
+
+func TestRunLimitsAcrossCases(t *testing.T) {
+	cases := `{"stdin":"` + strings.Repeat("x", 300) + `"}`
+	cases += strings.Repeat(","+cases, 9)
+	events, res := run(t, `{"command":"cat","stdoutLimit":1000,"cases":[`+cases+`]}`)
+
+	var size int
+	for _, e := range events {
+		b, _ := json.Marshal(e)
+		size += len(b) + 1
+	}
+	if size > 1000 || !res.Truncated || res.Output.Stdout != 3000 || len(res.Cases) != 10 {
+		t.Errorf("expected the limit to apply to all cases, actual %d bytes: %+v", size, res)
+	}
+}
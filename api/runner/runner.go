@@ -2,13 +2,14 @@ package runner
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 )
 
 func writeJSON(w io.Writer, v interface{}) {
@@ -17,7 +18,8 @@ func writeJSON(w io.Writer, v interface{}) {
 
 func Run(r io.Reader, w io.Writer) {
 	var payload Payload
-	if err := json.NewDecoder(r).Decode(&payload); err != nil {
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(&payload); err != nil {
 		writeJSON(w, &Result{Error: "Failed to parse input json: " + err.Error()})
 		return
 	}
@@ -27,7 +29,22 @@ func Run(r io.Reader, w io.Writer) {
 		return
 	}
 
-	runCommand(w, &payload)
+	o := newOutput(w, payload.StdoutLimit, payload.StderrLimit)
+	var stdin io.Reader = strings.NewReader(payload.Stdin)
+	if payload.Interactive {
+		stdin = io.MultiReader(stdin, dec.Buffered(), r)
+	}
+	res := runCommand(o, &payload, stdin)
+	o.setStats(res)
+	if len(payload.Artifacts) > 0 {
+		artifacts, err := collectArtifacts(payload.Artifacts, payload.ArtifactSizeLimit)
+		if err != nil {
+			res.Error = "Failed to collect artifacts: " + err.Error()
+		}
+		res.Artifacts = artifacts
+	}
+
+	writeJSON(w, res)
 }
 
 func writeFiles(files []*File) error {
@@ -40,14 +57,27 @@ func writeFiles(files []*File) error {
 }
 
 func writeFile(file *File) error {
-	if err := os.MkdirAll(filepath.Dir(file.Name), 0755); err != nil {
+	name := filepath.Clean(file.Name)
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return errors.New("file name outside of working directory: " + file.Name)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(file.Name, []byte(file.Content), 0755); err != nil {
+	b, err := file.Bytes()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, file.perm())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
 		return err
 	}
 
-	return nil
+	return f.Close()
 }
 
 func getExitCode(err error) *int {
@@ -58,30 +88,126 @@ func getExitCode(err error) *int {
 	if exitError, ok := err.(*exec.ExitError); ok {
 		ws := exitError.Sys().(syscall.WaitStatus)
 		c := ws.ExitStatus()
+		if ws.Signaled() {
+			c = 128 + int(ws.Signal())
+		}
 		return &c
 	}
 	return nil
 }
 
-func runCommand(w io.Writer, payload *Payload) {
-	cmd := exec.Command("sh", "-c", payload.Command)
-	cmd.Stdin = strings.NewReader(payload.Stdin)
-
-	ew := &eventWriter{w}
-	cmd.Stdout = ew
-	cmd.Stderr = ew
-	cmd.Env = os.Environ()
+func runCommand(o *output, payload *Payload, stdin io.Reader) *Result {
+	env := os.Environ()
+	for k, v := range payload.Env {
+		env = append(env, k+"="+v)
+	}
 	if len(payload.Files) > 0 {
-		cmd.Env = append(cmd.Env, "FILE="+payload.Files[0].Name)
+		env = append(env, "FILE="+payload.Files[0].Name)
 	}
-	err := cmd.Run()
+	env = append(env, "ARGS="+strings.Join(payload.Args, " "))
 
 	res := &Result{}
+	if payload.Compile != "" {
+		res.Compile = runPhase(o, Event{Phase: CompilePhase}, payload.Compile, strings.NewReader(""), nil, env)
+		if res.Compile.ExitCode == nil || *res.Compile.ExitCode != 0 {
+			res.setOutcome(res.Compile)
+			return res
+		}
+	}
+
+	if len(payload.Cases) == 0 {
+		res.Run = runPhase(o, Event{Phase: RunPhase}, payload.Command, stdin, payload.Args, env)
+		res.setOutcome(res.Run)
+		return res
+	}
+
+	for i, c := range payload.Cases {
+		i := i
+		res.Cases = append(res.Cases, runPhase(o, Event{Phase: RunPhase, Case: &i}, payload.Command, strings.NewReader(c.Stdin), payload.Args, env))
+	}
+	res.setOutcome(firstFailedPhase(res.Cases))
+	return res
+}
+
+// firstFailedPhase returns the first phase which did not exit successfully,
+// or the last one if all of them succeeded.
+func firstFailedPhase(ps []*PhaseResult) *PhaseResult {
+	for _, p := range ps {
+		if p.ExitCode == nil || *p.ExitCode != 0 {
+			return p
+		}
+	}
+	return ps[len(ps)-1]
+}
+
+// runPhase runs command with sh. The args are passed as positional
+// parameters so they are available as "$@".
+func runPhase(o *output, tag Event, command string, stdin io.Reader, args, env []string) *PhaseResult {
+	cmd := exec.Command("sh", append([]string{"-c", command, "sh"}, args...)...)
+	cmd.Stdout, cmd.Stderr = o.writers(tag)
+	cmd.Env = env
+
+	start := time.Now()
+	err := startWithStdin(cmd, stdin)
+	if err == nil {
+		err = cmd.Wait()
+	}
+
+	res := &PhaseResult{}
+	res.Duration = durationMs(time.Since(start))
 	res.ExitCode = getExitCode(err)
+	setUsage(res, cmd.ProcessState)
 
-	if res.ExitCode == nil || *res.ExitCode < 0 {
+	if res.ExitCode == nil {
 		res.Error = err.Error()
 	}
 
-	writeJSON(w, res)
+	return res
+}
+
+// startWithStdin starts cmd and copies stdin to it in the background.
+// Unlike cmd.Stdin, Wait does not block until stdin is exhausted, which
+// would never happen for an interactive run when the program exits first.
+func startWithStdin(cmd *exec.Cmd, stdin io.Reader) error {
+	pw, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(pw, stdin)
+		pw.Close()
+	}()
+	return nil
+}
+
+func setUsage(res *PhaseResult, ps *os.ProcessState) {
+	if ps == nil {
+		return
+	}
+	res.UserTime = durationMs(ps.UserTime())
+	res.SystemTime = durationMs(ps.SystemTime())
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		// ru_maxrss is reported in kilobytes on linux
+		res.MaxRSS = ru.Maxrss * 1024
+	}
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok {
+		return
+	}
+	if ws.Signaled() {
+		res.Signal = newSignal(ws)
+	} else {
+		// sh -c runs most commands as its child
+		res.Signal = shellSignal(ws.ExitStatus())
+	}
+	if res.Signal != nil {
+		res.Reason = res.Signal.reason()
+	}
+}
+
+func durationMs(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
 }
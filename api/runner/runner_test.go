@@ -0,0 +1,196 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func decodeEvents(t *testing.T, b []byte) []*Event {
+	var events []*Event
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, &e)
+	}
+	return events
+}
+
+// inTempDir runs f in a new temporary working directory.
+func inTempDir(t *testing.T, f func()) {
+	dir, err := ioutil.TempDir("", "runner-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	f()
+}
+
+// run runs the payload with runner.Run and returns the events and the result.
+func run(t *testing.T, payload string) ([]*Event, *Result) {
+	var buf bytes.Buffer
+	inTempDir(t, func() {
+		Run(strings.NewReader(payload), &buf)
+	})
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	var res Result
+	if err := json.Unmarshal(lines[len(lines)-1], &res); err != nil {
+		t.Fatal(err)
+	}
+	return decodeEvents(t, bytes.Join(lines[:len(lines)-1], []byte("\n"))), &res
+}
+
+func mustQuote(s string) string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func TestRunSignals(t *testing.T) {
+	var signalTests = []struct {
+		command  string
+		exitCode int
+		signal   syscall.Signal
+		reason   string
+	}{
+		{`kill -SEGV $$`, 128 + 11, syscall.SIGSEGV, "Segmentation fault"},
+		// the shell runs the killed program as its child
+		{`sh -c 'kill -KILL $$'; exit $?`, 128 + 9, syscall.SIGKILL, "Killed"},
+		{`exit 3`, 3, 0, ""},
+	}
+
+	for _, tt := range signalTests {
+		_, res := run(t, `{"command":`+mustQuote(tt.command)+`}`)
+		if res.ExitCode == nil || *res.ExitCode != tt.exitCode || res.Reason != tt.reason {
+			t.Errorf("%s: unexpected result %+v", tt.command, res)
+		}
+		if tt.signal == 0 && res.Signal != nil || tt.signal != 0 && (res.Signal == nil || res.Signal.Number != int(tt.signal)) {
+			t.Errorf("%s: expected signal %d, actual %+v", tt.command, tt.signal, res.Signal)
+		}
+	}
+}
+
+func TestSetOOMKilledChild(t *testing.T) {
+	_, res := run(t, `{"command":"sh -c 'kill -KILL $$'; exit $?"}`)
+	res.SetOOMKilled()
+	if res.Reason != reasonOOMKilled || res.Run.Reason != reasonOOMKilled {
+		t.Errorf("expected out of memory reason, actual %+v %+v", res, res.Run)
+	}
+}
+
+func TestRunFileModes(t *testing.T) {
+	events, res := run(t, `{"command":"./script && stat -c %a data","files":[
+		{"name":"script","content":"#!/bin/sh\necho ok"},
+		{"name":"data","content":"","mode":"readonly"}
+	]}`)
+	var stdout string
+	for _, e := range events {
+		stdout += e.Message
+	}
+	if stdout != "ok\n444\n" || res.ExitCode == nil || *res.ExitCode != 0 {
+		t.Errorf("unexpected output %q: %+v", stdout, res)
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	_, res := run(t, `{"compile":"true","command":"i=0; while [ $i -lt 100000 ]; do i=$((i+1)); done"}`)
+	if res.Compile == nil || res.Compile.MaxRSS <= 0 {
+		t.Errorf("expected usage of the compile phase, actual %+v", res.Compile)
+	}
+	p := res.Run
+	if p == nil || p.UserTime+p.SystemTime <= 0 || p.MaxRSS < 100*1024 || p.Duration < p.UserTime {
+		t.Errorf("expected cpu time and peak rss, actual %+v", p)
+	}
+}
+
+func TestRunCases(t *testing.T) {
+	events, res := run(t, `{
+		"compile": "echo >> compiled",
+		"command": "read l; echo $l $(wc -l < compiled); [ $l != b ]",
+		"cases": [{"stdin": "a\n"}, {"stdin": "b\n"}, {"stdin": "c\n"}]
+	}`)
+	var out []string
+	for _, e := range events {
+		if e.Case == nil {
+			t.Fatalf("expected case of event %+v", e)
+		}
+		out = append(out, strconv.Itoa(*e.Case)+":"+e.Message)
+	}
+	if strings.Join(out, "") != "0:a 1\n1:b 1\n2:c 1\n" {
+		t.Errorf("expected a single compile and all cases, actual %q", out)
+	}
+	if len(res.Cases) != 3 || res.Run != nil || res.ExitCode == nil || *res.ExitCode != 1 {
+		t.Errorf("expected the exit code of the failed case, actual %+v", res)
+	}
+}
+
+func TestRunArtifacts(t *testing.T) {
+	_, res := run(t, `{
+		"command": "mkdir -p out/dir && echo b > out/b.txt && echo a > out/a.txt && head -c 100 /dev/zero > out/large",
+		"artifacts": ["out/*.txt", "out/*"],
+		"artifactSizeLimit": 20
+	}`)
+	var names []string
+	for _, a := range res.Artifacts {
+		names = append(names, a.Name)
+	}
+	if strings.Join(names, ",") != "out/a.txt,out/b.txt,out/large" {
+		t.Fatalf("expected sorted regular files without duplicates, actual %v", names)
+	}
+	a, large := res.Artifacts[0], res.Artifacts[2]
+	if a.Size != 2 || a.Content != base64.StdEncoding.EncodeToString([]byte("a\n")) {
+		t.Errorf("unexpected artifact %+v", a)
+	}
+	if large.Size != 100 || !large.TooLarge || large.Content != "" {
+		t.Errorf("expected artifact to be too large, actual %+v", large)
+	}
+}
+
+func TestRunBase64Files(t *testing.T) {
+	events, res := run(t, `{
+		"command": "printf '\\000\\377hi' | cmp - data && echo same",
+		"files": [{"name": "data", "content": "AP9oaQ==", "encoding": "base64"}]
+	}`)
+	if len(events) != 1 || events[0].Message != "same\n" || res.ExitCode == nil || *res.ExitCode != 0 {
+		t.Errorf("expected decoded file, actual %+v", res)
+	}
+
+	_, res = run(t, `{"command": "true", "files": [{"name": "data", "content": "!", "encoding": "base64"}]}`)
+	if !strings.HasPrefix(res.Error, "Failed to write file to disk") {
+		t.Errorf("expected error for invalid base64, actual %+v", res)
+	}
+}
+
+func TestRunArgsAndEnv(t *testing.T) {
+	events, res := run(t, `{
+		"command": "printf '%s|' \"$@\"; echo \"$GREETING $ARGS\"",
+		"args": ["a b", "c"],
+		"env": {"GREETING": "hi"}
+	}`)
+	var stdout string
+	for _, e := range events {
+		stdout += e.Message
+	}
+	if stdout != "a b|c|hi a b c\n" {
+		t.Errorf("expected args and env, actual %q %+v", stdout, res)
+	}
+}
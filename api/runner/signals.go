@@ -0,0 +1,67 @@
+package runner
+
+import (
+	"strings"
+	"syscall"
+)
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+	syscall.SIGSYS:  "SIGSYS",
+}
+
+const reasonOOMKilled = "Killed (out of memory)"
+
+type Signal struct {
+	Number     int    `json:"number"`
+	Name       string `json:"name,omitempty"`
+	CoreDumped bool   `json:"coreDumped,omitempty"`
+}
+
+func newSignal(ws syscall.WaitStatus) *Signal {
+	sig := ws.Signal()
+	return &Signal{
+		Number:     int(sig),
+		Name:       signalNames[sig],
+		CoreDumped: ws.CoreDump(),
+	}
+}
+
+// shellSignal returns the signal which killed a child of the shell, as the
+// shell exits with 128 plus its number then, or nil.
+func shellSignal(exitCode int) *Signal {
+	sig := syscall.Signal(exitCode - 128)
+	if exitCode <= 128 || signalNames[sig] == "" {
+		return nil
+	}
+	return &Signal{Number: int(sig), Name: signalNames[sig]}
+}
+
+// reason returns a human-readable description in the style of a shell,
+// e.g. "Segmentation fault (core dumped)".
+func (s *Signal) reason() string {
+	r := syscall.Signal(s.Number).String()
+	if r != "" {
+		r = strings.ToUpper(r[:1]) + r[1:]
+	}
+	if s.CoreDumped {
+		r += " (core dumped)"
+	}
+	return r
+}
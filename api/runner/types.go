@@ -1,7 +1,11 @@
 package runner
 
 import (
-	"io"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -10,22 +14,133 @@ type EventType string
 const (
 	Stdout EventType = "stdout"
 	Stderr EventType = "stderr"
+	// Queued is sent while a run waits for a free slot
+	Queued EventType = "queued"
+)
+
+type Phase string
+
+const (
+	CompilePhase Phase = "compile"
+	RunPhase     Phase = "run"
 )
 
 type Event struct {
-	Type    EventType `json:"type"`
-	Message string    `json:"message"`
-	Time    time.Time `json:"-"`
+	Type     EventType `json:"type"`
+	Phase    Phase     `json:"phase,omitempty"`
+	Case     *int      `json:"case,omitempty"`
+	Position int       `json:"position,omitempty"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"-"`
 }
 
 type Result struct {
-	Events   []*Event `json:"events,omitempty"`
-	Error    string   `json:"error,omitempty"`
-	ExitCode *int     `json:"exitCode,omitempty"`
+	Events    []*Event       `json:"events,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	ExitCode  *int           `json:"exitCode,omitempty"`
+	Signal    *Signal        `json:"signal,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
+	Compile   *PhaseResult   `json:"compile,omitempty"`
+	Run       *PhaseResult   `json:"run,omitempty"`
+	Cases     []*PhaseResult `json:"cases,omitempty"`
+	Artifacts []*Artifact    `json:"artifacts,omitempty"`
+	OOMKilled bool           `json:"oomKilled,omitempty"`
+	TimedOut  bool           `json:"timedOut,omitempty"`
+	Verdict   *Verdict       `json:"verdict,omitempty"`
+	Cached    bool           `json:"cached,omitempty"`
+	Limits    *Limits        `json:"limits,omitempty"`
+	Output    *Output        `json:"output,omitempty"`
+	// Truncated is set if stdout, stderr or all events together exceeded
+	// their limit, only the first bytes were sent
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Output holds the number of bytes written to stdout and stderr, including
+// the bytes which were cut because of the limits.
+type Output struct {
+	Stdout int64 `json:"stdout"`
+	Stderr int64 `json:"stderr"`
+}
+
+// Limits are the resource limits the run was executed with. Timeout is in
+// milliseconds and Memory in bytes, zero means unlimited.
+type Limits struct {
+	Timeout int64   `json:"timeout"`
+	Memory  int64   `json:"memory"`
+	CPUs    float64 `json:"cpus"`
+	Pids    int64   `json:"pids"`
+	Network string  `json:"network"`
+}
+
+// PhaseResult holds the outcome of a single compile or run step.
+// Duration, UserTime and SystemTime are in milliseconds, MaxRSS is in bytes.
+type PhaseResult struct {
+	Events     []*Event `json:"events,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	ExitCode   *int     `json:"exitCode,omitempty"`
+	Signal     *Signal  `json:"signal,omitempty"`
+	Reason     string   `json:"reason,omitempty"`
+	Duration   int64    `json:"duration"`
+	UserTime   int64    `json:"userTime"`
+	SystemTime int64    `json:"systemTime"`
+	MaxRSS     int64    `json:"maxRss"`
+}
+
+type VerdictStatus string
+
+const (
+	Accepted          VerdictStatus = "Accepted"
+	WrongAnswer       VerdictStatus = "Wrong Answer"
+	RuntimeError      VerdictStatus = "Runtime Error"
+	TimeLimitExceeded VerdictStatus = "Time Limit Exceeded"
+	CompileError      VerdictStatus = "Compile Error"
+)
+
+type Verdict struct {
+	Status VerdictStatus  `json:"status"`
+	Cases  []*CaseVerdict `json:"cases,omitempty"`
+}
+
+type CaseVerdict struct {
+	Status VerdictStatus `json:"status"`
+	Diff   string        `json:"diff,omitempty"`
 }
 
 func (res *Result) Append(e *Event) {
 	res.Events = append(res.Events, e)
+	switch {
+	case e.Phase == CompilePhase && res.Compile != nil:
+		res.Compile.Events = append(res.Compile.Events, e)
+	case e.Phase == RunPhase && e.Case != nil && *e.Case < len(res.Cases):
+		res.Cases[*e.Case].Events = append(res.Cases[*e.Case].Events, e)
+	case e.Phase == RunPhase && res.Run != nil:
+		res.Run.Events = append(res.Run.Events, e)
+	}
+}
+
+func (res *Result) setOutcome(p *PhaseResult) {
+	res.ExitCode = p.ExitCode
+	res.Error = p.Error
+	res.Signal = p.Signal
+	res.Reason = p.Reason
+}
+
+// SetOOMKilled marks the result as killed by the memory cgroup and replaces
+// the generic reason of a SIGKILL with a more specific one.
+func (res *Result) SetOOMKilled() {
+	res.OOMKilled = true
+	if res.Signal == nil && res.ExitCode != nil {
+		return
+	}
+	if res.Signal != nil && res.Signal.Number != int(syscall.SIGKILL) {
+		return
+	}
+	res.Reason = reasonOOMKilled
+	for _, p := range append([]*PhaseResult{res.Compile, res.Run}, res.Cases...) {
+		if p != nil && p.Signal != nil && p.Signal.Number == int(syscall.SIGKILL) {
+			p.Reason = reasonOOMKilled
+		}
+	}
 }
 
 func (res *Result) IsEmpty() bool {
@@ -33,25 +148,69 @@ func (res *Result) IsEmpty() bool {
 }
 
 type Payload struct {
-	Files   []*File `json:"files"`
-	Stdin   string  `json:"stdin,omitempty" bson:",omitempty"`
-	Command string  `json:"command,omitempty" bson:",omitempty"`
+	Files   []*File           `json:"files"`
+	Stdin   string            `json:"stdin,omitempty" bson:",omitempty"`
+	Cases   []*Case           `json:"cases,omitempty" bson:",omitempty"`
+	Compile string            `json:"compile,omitempty" bson:",omitempty"`
+	Command string            `json:"command,omitempty" bson:",omitempty"`
+	Args    []string          `json:"args,omitempty" bson:",omitempty"`
+	Env     map[string]string `json:"env,omitempty" bson:",omitempty"`
+	// Artifacts are glob patterns of files returned after the run
+	Artifacts         []string `json:"artifacts,omitempty" bson:",omitempty"`
+	ArtifactSizeLimit int64    `json:"artifactSizeLimit,omitempty" bson:"-"`
+	// StdoutLimit and StderrLimit are the maximum sizes of the events of
+	// the streams, zero means unlimited
+	StdoutLimit int64 `json:"stdoutLimit,omitempty" bson:"-"`
+	StderrLimit int64 `json:"stderrLimit,omitempty" bson:"-"`
+	// Interactive streams everything following the payload json to the
+	// stdin of the run phase, after Stdin
+	Interactive bool `json:"interactive,omitempty" bson:"-"`
 }
 
-type File struct {
-	Name    string `json:"name"`
-	Content string `json:"content"`
+// Case is a single input for batch execution. The program is compiled once
+// and then run once per case.
+type Case struct {
+	Stdin string `json:"stdin,omitempty" bson:",omitempty"`
 }
 
-type eventWriter struct {
-	w io.Writer
+type Encoding string
+
+const (
+	UTF8Encoding   Encoding = "utf8"
+	Base64Encoding Encoding = "base64"
+)
+
+type FileMode string
+
+const (
+	ExecutableMode FileMode = "executable"
+	ReadOnlyMode   FileMode = "readonly"
+)
+
+type File struct {
+	Name     string   `json:"name"`
+	Content  string   `json:"content"`
+	Encoding Encoding `json:"encoding,omitempty" bson:",omitempty"`
+	Mode     FileMode `json:"mode,omitempty" bson:",omitempty"`
 }
 
-func (ew *eventWriter) Write(b []byte) (n int, err error) {
-	writeJSON(ew.w, &Event{
-		Type:    Stdout,
-		Message: string(b),
-	})
+// perm returns the permissions of the file. Files without a mode are
+// executable, like they were before modes were added.
+func (f *File) perm() os.FileMode {
+	if f.Mode == ReadOnlyMode {
+		return 0444
+	}
+	return 0755
+}
 
-	return len(b), nil
+// Bytes returns the decoded content of the file.
+func (f *File) Bytes() ([]byte, error) {
+	switch f.Encoding {
+	case "", UTF8Encoding:
+		return []byte(f.Content), nil
+	case Base64Encoding:
+		return base64.StdEncoding.DecodeString(f.Content)
+	default:
+		return nil, errors.New("unknown encoding " + strconv.Quote(string(f.Encoding)))
+	}
 }
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/rojul/snip/api/runner"
+)
+
+var errQueueFull = errors.New("run queue is full")
+
+// scheduler limits the number of runs globally and per language. Runs which
+// can not start immediately wait in a bounded FIFO queue. A nil scheduler
+// does not limit anything.
+type scheduler struct {
+	maxRunning     int
+	maxPerLanguage func(language string) int
+	maxQueued      int
+
+	mu      sync.Mutex
+	running int
+	perLang map[string]int
+	queue   []*ticket
+}
+
+type ticket struct {
+	s        *scheduler
+	language string
+	// ready is closed as soon as the run may start
+	ready    chan struct{}
+	position chan int
+	released bool
+}
+
+func (h *handler) newScheduler() *scheduler {
+	return newScheduler(h.config.MaxConcurrency, h.config.QueueSize, func(id string) int {
+		if l, err := h.getLanguage(id); err == nil && l.MaxConcurrency > 0 {
+			return l.MaxConcurrency
+		}
+		return h.config.LanguageConcurrency
+	})
+}
+
+func newScheduler(maxRunning, maxQueued int, maxPerLanguage func(string) int) *scheduler {
+	return &scheduler{
+		maxRunning:     maxRunning,
+		maxPerLanguage: maxPerLanguage,
+		maxQueued:      maxQueued,
+		perLang:        map[string]int{},
+	}
+}
+
+// enqueue returns a ticket for a run of the language. It fails with
+// errQueueFull if the run can not start immediately and the queue is full.
+func (s *scheduler) enqueue(language string) (*ticket, error) {
+	t := &ticket{
+		s:        s,
+		language: language,
+		ready:    make(chan struct{}),
+		position: make(chan int, 1),
+	}
+	if s == nil {
+		close(t.ready)
+		return t, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hasCapacity(language) && !s.isQueued(language) {
+		s.start(t)
+		return t, nil
+	}
+	if len(s.queue) >= s.maxQueued {
+		return nil, errQueueFull
+	}
+	s.queue = append(s.queue, t)
+	s.notify()
+	return t, nil
+}
+
+func (s *scheduler) hasCapacity(language string) bool {
+	if s.maxRunning > 0 && s.running >= s.maxRunning {
+		return false
+	}
+	max := s.maxPerLanguage(language)
+	return max <= 0 || s.perLang[language] < max
+}
+
+func (s *scheduler) isQueued(language string) bool {
+	for _, t := range s.queue {
+		if t.language == language {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scheduler) start(t *ticket) {
+	s.running++
+	s.perLang[t.language]++
+	close(t.ready)
+}
+
+// dispatch starts queued runs in order as long as there is capacity and
+// notifies the remaining ones about their new position.
+func (s *scheduler) dispatch() {
+	var queue []*ticket
+	for _, t := range s.queue {
+		if s.hasCapacity(t.language) {
+			s.start(t)
+		} else {
+			queue = append(queue, t)
+		}
+	}
+	s.queue = queue
+	s.notify()
+}
+
+func (s *scheduler) notify() {
+	for i, t := range s.queue {
+		select {
+		case <-t.position:
+		default:
+		}
+		t.position <- i + 1
+	}
+}
+
+// wait blocks until the run may start and sends queue events with the
+// current position in the meantime.
+func (t *ticket) wait(ctx context.Context, events chan<- *runner.Event) error {
+	for {
+		select {
+		case <-t.ready:
+			return nil
+		case p := <-t.position:
+			events <- &runner.Event{Type: runner.Queued, Position: p}
+		case <-ctx.Done():
+			t.release()
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees the slot of a started run or removes a waiting run from the
+// queue. It may be called more than once.
+func (t *ticket) release() {
+	s := t.s
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.released {
+		return
+	}
+	t.released = true
+
+	select {
+	case <-t.ready:
+		s.running--
+		s.perLang[t.language]--
+	default:
+		for i, qt := range s.queue {
+			if qt == t {
+				s.queue = append(s.queue[:i], s.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	s.dispatch()
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rojul/snip/api/runner"
+)
+
+func isReady(t *ticket) bool {
+	select {
+	case <-t.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler(2, 1, func(l string) int {
+		if l == "java" {
+			return 1
+		}
+		return 0
+	})
+
+	java1, _ := s.enqueue("java")
+	java2, _ := s.enqueue("java")
+	ash1, _ := s.enqueue("ash")
+	if !isReady(java1) || isReady(java2) || !isReady(ash1) {
+		t.Fatal("expected the second java run to be queued")
+	}
+	if _, err := s.enqueue("ash"); err != errQueueFull {
+		t.Fatalf("expected errQueueFull, actual %v", err)
+	}
+
+	events := make(chan *runner.Event, 1)
+	done := make(chan error)
+	go func() { done <- java2.wait(context.Background(), events) }()
+	if e := <-events; e.Type != runner.Queued || e.Position != 1 {
+		t.Errorf("expected queue position 1, actual %s %d", e.Type, e.Position)
+	}
+
+	ash1.release()
+	if isReady(java2) {
+		t.Fatal("expected the java run to wait for the other java run")
+	}
+	java1.release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	java2.release()
+	java2.release()
+	if s.running != 0 || len(s.queue) != 0 {
+		t.Errorf("expected empty scheduler, actual %d running and %d queued", s.running, len(s.queue))
+	}
+}
+
+func TestRunHandlerQueueFull(t *testing.T) {
+	h := newFakeHandler()
+	h.scheduler = newScheduler(1, 0, func(string) int { return 0 })
+	running, _ := h.scheduler.enqueue("ash")
+	defer running.release()
+
+	w := doTestRequest(h, "POST", "/run", `{"language":"ash","files":[{"name":"main.sh","content":""}]}`)
+	expectStatus(t, w, http.StatusServiceUnavailable)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header")
+	}
+}
+
+func TestRunHandlerQueueTimeout(t *testing.T) {
+	h := newFakeHandler()
+	h.config.QueueTimeout = 10 * time.Millisecond
+	h.scheduler = newScheduler(1, 1, func(string) int { return 0 })
+	running, _ := h.scheduler.enqueue("ash")
+	defer running.release()
+
+	w := doTestRequest(h, "POST", "/run", `{"language":"ash","files":[{"name":"main.sh","content":""}]}`)
+	expectStatus(t, w, http.StatusOK)
+	if _, r := decodeRunResponse(t, w.Body.String()); r.Error != "Timed out waiting for a free slot" {
+		t.Errorf("unexpected response: %s", w.Body.String())
+	}
+	if len(h.scheduler.queue) != 0 {
+		t.Error("expected the timed out run to leave the queue")
+	}
+}
@@ -21,6 +21,7 @@ func (h *handler) getSnippetCollection() *mgo.Collection {
 func (h *handler) snippetsRouter(r *mux.Router) {
 	r.HandleFunc("", h.createSnippetsHandler).Methods("POST")
 	r.HandleFunc("/{id}", h.getSnippetsHandler).Methods("GET")
+	r.HandleFunc("/{id}/run", h.runSnippetHandler).Methods("POST")
 }
 
 func (h *handler) createSnippetsHandler(w http.ResponseWriter, r *http.Request) {
@@ -29,6 +30,7 @@ func (h *handler) createSnippetsHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	snippet.normalize()
 	if err := snippet.getValidationError(); err != nil {
 		sendError(w, HTTPError{Status: http.StatusBadRequest, Msg: "Invalid payload: " + err.Error()})
 		return
@@ -81,3 +83,44 @@ func (h *handler) getSnippet(id bson.ObjectId) (*Snippet, error) {
 
 	return &snippet, nil
 }
+
+// snippetRunOptions replaces the stdin or args of a snippet when it is run.
+type snippetRunOptions struct {
+	Stdin *string  `json:"stdin"`
+	Args  []string `json:"args"`
+}
+
+func (h *handler) runSnippetHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := parseSnippetID(mux.Vars(r)["id"])
+	if err != nil {
+		sendError(w, HTTPErrorInvalidSnippetID)
+		return
+	}
+
+	var opts snippetRunOptions
+	if ok := readOptionalJSONBody(w, r, h.config.SnippetSizeLimit, &opts); !ok {
+		return
+	}
+
+	snippet, err := h.getSnippet(id)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	payload := snippet.Payload
+	if opts.Stdin != nil {
+		payload.Stdin = *opts.Stdin
+	}
+	if opts.Args != nil {
+		payload.Args = opts.Args
+	}
+
+	language, t, err := h.prepareRun(r, &payload)
+	if err != nil {
+		h.sendRunError(w, err)
+		return
+	}
+
+	h.streamRun(w, r, &payload, language, t)
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// sseHeartbeat is the interval of comments which keep idle streams open
+// through proxies.
+var sseHeartbeat = 15 * time.Second
+
+const sseResult = "result"
+
+func acceptsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// streamWriter sends the events and results of runs to the client. The event
+// name is only used for server-sent events.
+type streamWriter interface {
+	send(event string, v interface{})
+	keepAlive()
+}
+
+// newStreamWriter returns a sseWriter if the client accepts server-sent
+// events and a ndjsonWriter otherwise.
+func newStreamWriter(w http.ResponseWriter, r *http.Request, id int) streamWriter {
+	if acceptsEventStream(r) {
+		return newSSEWriter(w, id)
+	}
+	return newNDJSONWriter(w)
+}
+
+// ndjsonWriter writes every value as a line of json.
+type ndjsonWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func newNDJSONWriter(w http.ResponseWriter) *ndjsonWriter {
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	f, _ := w.(http.Flusher)
+	if f == nil {
+		log.Debug("streaming unsupported")
+	}
+	return &ndjsonWriter{w: w, f: f}
+}
+
+func (n *ndjsonWriter) send(event string, v interface{}) {
+	json.NewEncoder(n.w).Encode(v)
+	if n.f != nil {
+		n.f.Flush()
+	}
+}
+
+func (n *ndjsonWriter) keepAlive() {}
+
+// sseWriter writes server-sent events with consecutive ids, the first id is
+// one more than the initial id.
+type sseWriter struct {
+	w    io.Writer
+	f    http.Flusher
+	id   int
+	last time.Time
+}
+
+// newSSEWriter writes the header of an event stream.
+func newSSEWriter(w http.ResponseWriter, id int) *sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	// disables response buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	f, _ := w.(http.Flusher)
+	if f == nil {
+		log.Debug("streaming unsupported")
+	}
+	return &sseWriter{w: w, f: f, id: id, last: time.Now()}
+}
+
+func (s *sseWriter) send(event string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	s.id++
+	fmt.Fprintf(s.w, "id: %d\nevent: %s\ndata: %s\n\n", s.id, event, b)
+	s.flush()
+}
+
+func (s *sseWriter) comment(c string) {
+	fmt.Fprintf(s.w, ": %s\n\n", c)
+	s.flush()
+}
+
+// keepAlive sends a heartbeat if nothing was sent for a while.
+func (s *sseWriter) keepAlive() {
+	if time.Since(s.last) >= sseHeartbeat {
+		s.comment("heartbeat")
+	}
+}
+
+func (s *sseWriter) flush() {
+	s.last = time.Now()
+	if s.f != nil {
+		s.f.Flush()
+	}
+}
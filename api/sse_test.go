@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rojul/snip/api/runner"
+)
+
+// slowExecutor delays the fake executor.
+type slowExecutor struct {
+	delay time.Duration
+}
+
+func (e slowExecutor) Execute(ctx context.Context, payload *runner.Payload, language *Language, resources Resources, stdin io.Reader, events chan<- *runner.Event) (*runner.Result, error) {
+	time.Sleep(e.delay)
+	return fakeExecutor{}.Execute(ctx, payload, language, resources, stdin, events)
+}
+
+func TestRunHandlerSSE(t *testing.T) {
+	defer func(d time.Duration) { sseHeartbeat = d }(sseHeartbeat)
+	sseHeartbeat = 10 * time.Millisecond
+	h := newFakeHandler()
+	h.executor = slowExecutor{50 * time.Millisecond}
+
+	body := `{"language":"ash","files":[{"name":"main.sh","content":"cat"}],"stdin":"Hello World\n"}`
+	r := httptest.NewRequest("POST", "/run", strings.NewReader(body))
+	r.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	h.getAPIHandler().ServeHTTP(w, r)
+	expectStatus(t, w, http.StatusOK)
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	res := w.Body.String()
+	if !strings.HasPrefix(res, ": heartbeat\n\n") {
+		t.Errorf("expected heartbeat: %s", res)
+	}
+	if !strings.Contains(res, "id: 1\nevent: stdout\ndata: {\"type\":\"stdout\",\"phase\":\"run\",\"message\":\"Hello World\\n\"}\n\n"+
+		"id: 2\nevent: result\ndata: {\"exitCode\":0,") || !strings.HasSuffix(res, "}\n\n") {
+		t.Errorf("unexpected response: %s", res)
+	}
+}
@@ -3,7 +3,10 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"path"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -16,16 +19,25 @@ import (
 var (
 	HTTPErrorInvalidSnippetID = HTTPError{Status: http.StatusBadRequest, Msg: "Invalid Snippet ID"}
 	HTTPErrorSnippetNotFound  = HTTPError{Status: http.StatusNotFound, Msg: "Snippet Not Found"}
+	HTTPErrorTooManyRuns      = HTTPError{Status: http.StatusServiceUnavailable, Msg: "Too many runs, try again later"}
+	HTTPErrorInvalidJobID     = HTTPError{Status: http.StatusBadRequest, Msg: "Invalid Run ID"}
+	HTTPErrorJobNotFound      = HTTPError{Status: http.StatusNotFound, Msg: "Run Not Found"}
+	HTTPErrorInvalidJobToken  = HTTPError{Status: http.StatusForbidden, Msg: "Invalid Cancel Token"}
 )
 
 type Language struct {
-	ID          string                  `json:"id" toml:"id"`
-	Name        string                  `json:"name,omitempty" toml:"name"`
-	Extension   string                  `json:"extension,omitempty" toml:"extension"`
-	Command     string                  `json:"command,omitempty" toml:"command"`
-	Image       string                  `json:"image,omitempty" toml:"image"`
-	NotRunnable bool                    `json:"notRunnable,omitempty" toml:"notRunnable"`
-	Tests       map[string]LanguageTest `json:"tests,omitempty" toml:"tests"`
+	ID             string                  `json:"id" toml:"id"`
+	Name           string                  `json:"name,omitempty" toml:"name"`
+	Extension      string                  `json:"extension,omitempty" toml:"extension"`
+	Compile        string                  `json:"compile,omitempty" toml:"compile"`
+	Run            string                  `json:"run,omitempty" toml:"run"`
+	Command        string                  `json:"command,omitempty" toml:"command"` // deprecated, used as Run if that is not set
+	Image          string                  `json:"image,omitempty" toml:"image"`
+	NotRunnable    bool                    `json:"notRunnable,omitempty" toml:"notRunnable"`
+	MaxConcurrency int                     `json:"maxConcurrency,omitempty" toml:"maxConcurrency"`
+	Network        bool                    `json:"network,omitempty" toml:"network"`
+	Limits         *Limits                 `json:"limits,omitempty" toml:"limits"`
+	Tests          map[string]LanguageTest `json:"tests,omitempty" toml:"tests"`
 }
 
 func (l *Language) getTestPayload(name string) runner.Payload {
@@ -56,11 +68,75 @@ func (l *Language) getTestPayload(name string) runner.Payload {
 	return p
 }
 
+// command returns a single command which compiles and runs, for clients
+// which still read the deprecated Command.
+func (l *Language) command() string {
+	if l.Compile == "" {
+		return l.Run
+	}
+	return l.Compile + " && " + l.Run
+}
+
 type LanguageTest map[string]string
 
+var envNamePattern = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// deniedEnvNames can not be set by a payload, as they are either set by the
+// runner or change how programs are loaded and executed.
+var deniedEnvNames = map[string]bool{
+	"PATH":      true,
+	"HOME":      true,
+	"USER":      true,
+	"SHELL":     true,
+	"IFS":       true,
+	"ENV":       true,
+	"BASH_ENV":  true,
+	"SHELLOPTS": true,
+	"BASHOPTS":  true,
+	"PS4":       true,
+	"FILE":      true,
+	"ARGS":      true,
+}
+
+func isDeniedEnvName(name string) bool {
+	return deniedEnvNames[name] || strings.HasPrefix(name, "LD_")
+}
+
 type Payload struct {
 	runner.Payload `bson:",inline"`
-	Language       string `json:"language,omitempty" bson:",omitempty"`
+	Language       string    `json:"language,omitempty" bson:",omitempty"`
+	Expected       *Expected `json:"expected,omitempty" bson:",omitempty"`
+	// Limits can lower the limits of the language. Raising them up to the
+	// maximums of the config requires the LimitsToken.
+	Limits *RunLimits `json:"limits,omitempty" bson:",omitempty"`
+	// Network requests access to the allowlisted hosts, if the language
+	// allows it
+	Network bool `json:"network,omitempty" bson:",omitempty"`
+	// stdin is streamed to interactive runs
+	stdin       io.Reader
+	noCache     bool
+	raiseLimits bool
+	// skipped is closed when another run of the batch failed
+	skipped <-chan struct{}
+}
+
+// isLocalPath reports whether name is a relative path which stays inside the
+// working directory.
+func isLocalPath(name string) bool {
+	if name == "" || path.IsAbs(name) {
+		return false
+	}
+	clean := path.Clean(name)
+	return clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// normalize cleans up user supplied values before validation.
+func (p *Payload) normalize() {
+	for _, file := range p.Files {
+		if file != nil && file.Name != "" {
+			file.Name = path.Clean(file.Name)
+		}
+	}
 }
 
 func (p *Payload) getValidationError() error {
@@ -73,10 +149,73 @@ func (p *Payload) getValidationError() error {
 	if len(p.Files) == 0 {
 		return errors.New("At least one file required")
 	}
+	if len(p.Cases) > 50 {
+		return errors.New("Too many cases")
+	}
+	if len(p.Cases) > 0 && p.Stdin != "" {
+		return errors.New("Stdin and cases can not be combined")
+	}
+	if len(p.Cases) > 0 && p.stdin != nil {
+		return errors.New("Interactive runs can not have cases")
+	}
+	for i, c := range p.Cases {
+		if c == nil {
+			return errors.New("Case " + strconv.Itoa(i+1) + " is null")
+		}
+	}
+	names := map[string]bool{}
 	for i, file := range p.Files {
+		if file == nil {
+			return errors.New("File " + strconv.Itoa(i+1) + " is null")
+		}
 		if file.Name == "" {
 			return errors.New("Filename required for file " + strconv.Itoa(i+1))
 		}
+		if !isLocalPath(file.Name) || file.Name == "." {
+			return errors.New("Invalid filename " + strconv.Quote(file.Name))
+		}
+		if names[file.Name] {
+			return errors.New("Duplicate filename " + strconv.Quote(file.Name))
+		}
+		names[file.Name] = true
+		switch file.Mode {
+		case "", runner.ExecutableMode, runner.ReadOnlyMode:
+		default:
+			return errors.New("Invalid mode of file " + strconv.Itoa(i+1))
+		}
+		if _, err := file.Bytes(); err != nil {
+			return errors.New("Invalid content of file " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+	if len(p.Args) > 100 {
+		return errors.New("Too many arguments")
+	}
+	if len(p.Env) > 50 {
+		return errors.New("Too many environment variables")
+	}
+	for name := range p.Env {
+		if !envNamePattern.MatchString(name) {
+			return errors.New("Invalid environment variable name " + strconv.Quote(name))
+		}
+		if isDeniedEnvName(name) {
+			return errors.New("Environment variable " + name + " can not be set")
+		}
+	}
+	if len(p.Artifacts) > 10 {
+		return errors.New("Too many artifact patterns")
+	}
+	for _, pattern := range p.Artifacts {
+		if _, err := path.Match(pattern, ""); err != nil || !isLocalPath(pattern) {
+			return errors.New("Invalid artifact pattern " + strconv.Quote(pattern))
+		}
+	}
+	if p.Limits != nil {
+		if err := p.Limits.getValidationError(); err != nil {
+			return err
+		}
+	}
+	if p.Expected != nil {
+		return p.Expected.getValidationError(len(p.Cases))
 	}
 	return nil
 }
@@ -110,3 +249,46 @@ func parseSnippetID(id string) (bson.ObjectId, error) {
 	}
 	return bson.ObjectIdHex(id), nil
 }
+
+type JobStatus string
+
+const (
+	JobRunning  JobStatus = "running"
+	JobDone     JobStatus = "done"
+	JobCanceled JobStatus = "canceled"
+)
+
+// Job is a run started with POST /runs. The events are stored while the job
+// is running, the result once it is finished.
+type Job struct {
+	ID          bson.ObjectId   `json:"id" bson:"_id"`
+	Language    string          `json:"language"`
+	Status      JobStatus       `json:"status"`
+	Events      []*runner.Event `json:"-" bson:",omitempty"`
+	Result      *runner.Result  `json:"result,omitempty" bson:",omitempty"`
+	Created     time.Time       `json:"created"`
+	Expires     time.Time       `json:"expires"`
+	CancelToken string          `json:"cancelToken,omitempty" bson:"cancelToken,omitempty"` // only returned on creation
+}
+
+func (j *Job) MarshalJSON() ([]byte, error) {
+	type Alias Job
+	return json.Marshal(&struct {
+		ID      string `json:"id"`
+		Created int64  `json:"created"`
+		Expires int64  `json:"expires"`
+		*Alias
+	}{
+		ID:      j.ID.Hex(),
+		Created: j.Created.Unix(),
+		Expires: j.Expires.Unix(),
+		Alias:   (*Alias)(j),
+	})
+}
+
+func parseJobID(id string) (bson.ObjectId, error) {
+	if !bson.IsObjectIdHex(id) {
+		return "", HTTPErrorInvalidJobID
+	}
+	return bson.ObjectIdHex(id), nil
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/rojul/snip/api/runner"
+)
+
+func TestPayloadFileValidation(t *testing.T) {
+	var fileTests = []struct {
+		names []string
+		valid bool
+	}{
+		{[]string{"main.go"}, true},
+		{[]string{"main.go", "lib/lib.go"}, true},
+		{[]string{"./main.go", "a/../lib.go"}, true},
+		{[]string{"main.go", "./main.go"}, false},
+		{[]string{"/etc/passwd"}, false},
+		{[]string{"../main.go"}, false},
+		{[]string{"a/../../main.go"}, false},
+		{[]string{"."}, false},
+	}
+
+	for _, tt := range fileTests {
+		p := &Payload{}
+		for _, name := range tt.names {
+			p.Files = append(p.Files, &runner.File{Name: name})
+		}
+		p.normalize()
+		if err := p.getValidationError(); (err == nil) != tt.valid {
+			t.Errorf("%v: expected valid %v, actual error %v", tt.names, tt.valid, err)
+		}
+	}
+}
+
+func TestPayloadEnvValidation(t *testing.T) {
+	var envTests = []struct {
+		name  string
+		valid bool
+	}{
+		{"NAME", true},
+		{"BASH_VERSION", true},
+		{"PATH", false},
+		{"ENV", false},
+		{"BASH_ENV", false},
+		{"SHELLOPTS", false},
+		{"BASHOPTS", false},
+		{"PS4", false},
+		{"LD_PRELOAD", false},
+		{"1NAME", false},
+	}
+
+	for _, tt := range envTests {
+		p := &Payload{}
+		p.Files = []*runner.File{{Name: "main.sh"}}
+		p.Env = map[string]string{tt.name: "x"}
+		p.normalize()
+		if err := p.getValidationError(); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid %v, actual error %v", tt.name, tt.valid, err)
+		}
+	}
+}
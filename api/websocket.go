@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rojul/snip/api/runner"
+	"golang.org/x/net/websocket"
+)
+
+// wsMessage is sent by the client of an interactive run after the payload.
+type wsMessage struct {
+	Type    string `json:"type"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	wsStdin = "stdin"
+	// wsClose closes the stdin of the program
+	wsClose = "close"
+)
+
+func (h *handler) runWSHandler(w http.ResponseWriter, r *http.Request) {
+	s := websocket.Server{
+		// the api does not use cookies, so any origin is allowed
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   h.runWS,
+	}
+	s.ServeHTTP(w, r)
+}
+
+// runWS reads the payload as first message, the following messages are
+// written to the stdin of the program. Events and the result are sent like
+// the lines of a /run response.
+func (h *handler) runWS(ws *websocket.Conn) {
+	defer ws.Close()
+	ws.MaxPayloadBytes = int(h.config.SnippetSizeLimit)
+
+	var payload Payload
+	if err := websocket.JSON.Receive(ws, &payload); err != nil {
+		sendWSError(ws, HTTPError{Status: http.StatusBadRequest, Msg: "Invalid JSON", Reason: err.Error()})
+		return
+	}
+	stdin := newStdinBuffer(int(h.config.SnippetSizeLimit))
+	defer stdin.CloseWithError(io.EOF)
+	payload.stdin = stdin
+
+	language, t, err := h.prepareRun(ws.Request(), &payload)
+	if err != nil {
+		sendWSError(ws, err)
+		return
+	}
+
+	// the deadlines of the http server would end the run early
+	ws.SetDeadline(time.Time{})
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+	go func() {
+		for {
+			var m wsMessage
+			if err := websocket.JSON.Receive(ws, &m); err != nil {
+				stdin.CloseWithError(err)
+				cancel()
+				return
+			}
+			switch m.Type {
+			case wsStdin:
+				// the write does not wait for the program, so a disconnect
+				// is noticed even if the program does not read its stdin
+				if _, err := stdin.Write([]byte(m.Message)); err == errStdinBufferFull {
+					cancel()
+					return
+				}
+			case wsClose:
+				stdin.CloseWithError(io.EOF)
+			}
+		}
+	}()
+
+	events := make(chan *runner.Event)
+	done := make(chan bool)
+	go func() {
+		for e := range events {
+			websocket.JSON.Send(ws, e)
+		}
+		done <- true
+	}()
+	r, err := h.runContainer(ctx, &payload, language, t, events)
+	<-done
+	if err != nil {
+		log.Error(err.Error())
+		r = &runner.Result{Error: http.StatusText(http.StatusInternalServerError)}
+	}
+	websocket.JSON.Send(ws, r)
+}
+
+var errStdinBufferFull = errors.New("stdin buffer full")
+
+// stdinBuffer is a pipe whose writes do not wait for reads. Writes fail
+// once more than limit bytes are waiting to be read.
+type stdinBuffer struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	buf   bytes.Buffer
+	limit int
+	err   error
+}
+
+func newStdinBuffer(limit int) *stdinBuffer {
+	b := &stdinBuffer{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *stdinBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, io.ErrClosedPipe
+	}
+	if b.buf.Len()+len(p) > b.limit {
+		b.err = errStdinBufferFull
+		b.cond.Broadcast()
+		return 0, b.err
+	}
+	b.buf.Write(p)
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// Read returns the buffered bytes, or the error of CloseWithError once the
+// buffer is empty.
+func (b *stdinBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.buf.Len() > 0 {
+		return b.buf.Read(p)
+	}
+	return 0, b.err
+}
+
+// CloseWithError makes reads return err after the buffered bytes, the
+// first error is kept.
+func (b *stdinBuffer) CloseWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+func sendWSError(ws *websocket.Conn, err error) {
+	websocket.JSON.Send(ws, toHTTPError(err))
+}
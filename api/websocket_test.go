@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rojul/snip/api/runner"
+	"golang.org/x/net/websocket"
+)
+
+func dialTestWS(t *testing.T, s *httptest.Server) *websocket.Conn {
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/run/ws", "", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func TestRunWS(t *testing.T) {
+	s := httptest.NewServer(newFakeHandler().getAPIHandler())
+	defer s.Close()
+	ws := dialTestWS(t, s)
+	defer ws.Close()
+
+	payload := `{"language":"ash","files":[{"name":"main.sh","content":"cat"}]}`
+	if err := websocket.Message.Send(ws, payload); err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []string{"hello", "world"} {
+		if err := websocket.JSON.Send(ws, &wsMessage{Type: wsStdin, Message: in + "\n"}); err != nil {
+			t.Fatal(err)
+		}
+		var e runner.Event
+		if err := websocket.JSON.Receive(ws, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != runner.Stdout || e.Message != in+"\n" {
+			t.Errorf("expected stdout %q, actual %s", in, mustToJSON(e))
+		}
+	}
+
+	websocket.JSON.Send(ws, &wsMessage{Type: wsClose})
+	var r runner.Result
+	if err := websocket.JSON.Receive(ws, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Error != "" || r.ExitCode == nil || *r.ExitCode != 0 {
+		t.Errorf("expected successful run, actual %s", mustToJSON(r))
+	}
+}
+
+func TestRunWSInvalidPayload(t *testing.T) {
+	s := httptest.NewServer(newFakeHandler().getAPIHandler())
+	defer s.Close()
+	ws := dialTestWS(t, s)
+	defer ws.Close()
+
+	payload := `{"language":"ash","files":[{"name":"main.sh"}],"cases":[{"stdin":"a"}]}`
+	websocket.Message.Send(ws, payload)
+	var e HTTPError
+	if err := websocket.JSON.Receive(ws, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Msg != "Invalid payload: Interactive runs can not have cases" {
+		t.Errorf("unexpected error %q", e.Msg)
+	}
+}
+
+// stdinIgnoringExecutor never reads stdin and runs until it is canceled.
+type stdinIgnoringExecutor struct {
+	canceled chan bool
+}
+
+func (e stdinIgnoringExecutor) Execute(ctx context.Context, payload *runner.Payload, language *Language, resources Resources, stdin io.Reader, events chan<- *runner.Event) (*runner.Result, error) {
+	defer close(events)
+	<-ctx.Done()
+	e.canceled <- true
+	return &runner.Result{}, nil
+}
+
+func TestRunWSDisconnect(t *testing.T) {
+	h := newFakeHandler()
+	e := stdinIgnoringExecutor{make(chan bool, 1)}
+	h.executor = e
+	s := httptest.NewServer(h.getAPIHandler())
+	defer s.Close()
+	ws := dialTestWS(t, s)
+
+	websocket.Message.Send(ws, `{"language":"ash","files":[{"name":"main.sh","content":"sleep 1d"}]}`)
+	for i := 0; i < 3; i++ {
+		websocket.JSON.Send(ws, &wsMessage{Type: wsStdin, Message: "ignored\n"})
+	}
+	ws.Close()
+
+	select {
+	case <-e.canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the run to be canceled after the disconnect")
+	}
+}
+
+func TestStdinBuffer(t *testing.T) {
+	b := newStdinBuffer(8)
+	if _, err := b.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write([]byte("world")); err != errStdinBufferFull {
+		t.Errorf("expected full buffer, actual %v", err)
+	}
+	if out, err := ioutil.ReadAll(b); string(out) != "hello" || err != errStdinBufferFull {
+		t.Errorf("expected buffered input and an error, actual %q %v", out, err)
+	}
+
+	b = newStdinBuffer(8)
+	b.Write([]byte("a"))
+	b.CloseWithError(io.EOF)
+	if out, err := ioutil.ReadAll(b); string(out) != "a" || err != nil {
+		t.Errorf("expected input before close, actual %q %v", out, err)
+	}
+}